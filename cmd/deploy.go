@@ -26,13 +26,15 @@ import (
 	"github.com/spf13/cobra"
 )
 
+var deployOptions configmanage.Options
+
 // deployCmd represents the deploy command
 var deployCmd = &cobra.Command{
 	Use:   "deploy",
 	Short: "Apply proposed changes to managed resources",
 	Long:  `Apply proposed changes to managed resources`,
-	Run: func(cmd *cobra.Command, args []string) {
-		configmanage.Deploy()
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return configmanage.Deploy(withGlobalOptions(deployOptions))
 	},
 }
 
@@ -48,4 +50,5 @@ func init() {
 	// Cobra supports local flags which will only run when this command
 	// is called directly, e.g.:
 	// deployCmd.Flags().BoolP("toggle", "t", false, "Help message for toggle")
+	deployCmd.Flags().BoolVar(&deployOptions.Stream, "stream", false, "Stream command output from each host as it is produced")
 }
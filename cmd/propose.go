@@ -26,13 +26,15 @@ import (
 	"github.com/spf13/cobra"
 )
 
+var proposeOptions configmanage.Options
+
 // proposeCmd represents the propose command
 var proposeCmd = &cobra.Command{
 	Use:   "propose",
 	Short: "Display proposed changes to managed resources",
 	Long:  `Display proposed changes to managed resources`,
-	Run: func(cmd *cobra.Command, args []string) {
-		configmanage.Propose()
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return configmanage.Propose(withGlobalOptions(proposeOptions))
 	},
 }
 
@@ -48,4 +50,5 @@ func init() {
 	// Cobra supports local flags which will only run when this command
 	// is called directly, e.g.:
 	// proposeCmd.Flags().BoolP("toggle", "t", false, "Help message for toggle")
+	proposeCmd.Flags().BoolVar(&proposeOptions.Stream, "stream", false, "Stream command output from each host as it is produced")
 }
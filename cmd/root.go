@@ -24,14 +24,23 @@ package cmd
 import (
 	"os"
 
+	"github.com/echoboomer/glueprint/pkg/configmanage"
 	"github.com/spf13/cobra"
 )
 
+// Paths and variables shared by every command, set with persistent
+// flags or their environment variables
+var globalOptions configmanage.Options
+
 // rootCmd represents the base command when called without any subcommands
 var rootCmd = &cobra.Command{
 	Use:   "glueprint",
 	Short: "A lightweight configuration management tool",
 	Long:  `A lightweight configuration management tool`,
+	// Errors are logged as they happen, so a failed command only needs
+	// to exit with a non-zero status
+	SilenceErrors: true,
+	SilenceUsage:  true,
 	// Uncomment the following line if your bare application
 	// has an action associated with it:
 	// Run: func(cmd *cobra.Command, args []string) { },
@@ -51,9 +60,32 @@ func init() {
 	// Cobra supports persistent flags, which, if defined here,
 	// will be global for your application.
 
-	// rootCmd.PersistentFlags().StringVar(&cfgFile, "config", "", "config file (default is $HOME/.glueprint.yaml)")
+	rootCmd.PersistentFlags().StringVar(&globalOptions.ConfigFile, "config", os.Getenv("GLUEPRINT_CONFIG"),
+		"Configuration file to use instead of searching the working directory for glue.yaml files (env GLUEPRINT_CONFIG)")
+	rootCmd.PersistentFlags().StringVar(&globalOptions.StateFile, "state", os.Getenv("GLUEPRINT_STATE"),
+		"State file (env GLUEPRINT_STATE, default glueprint-state.json in the working directory)")
+	rootCmd.PersistentFlags().StringVar(&globalOptions.WorkDir, "workdir", os.Getenv("GLUEPRINT_WORKDIR"),
+		"Directory to search for glue.yaml files (env GLUEPRINT_WORKDIR, default the current directory)")
+	rootCmd.PersistentFlags().StringArrayVar(&globalOptions.Vars, "var", nil,
+		"Set a variable used in configuration files as name=value, overriding its value in the file (can be repeated)")
+	rootCmd.PersistentFlags().StringArrayVar(&globalOptions.VarFiles, "var-file", nil,
+		"YAML file of variables overriding those in configuration files (can be repeated)")
+	rootCmd.PersistentFlags().StringVar(&globalOptions.Env, "env", os.Getenv("GLUEPRINT_ENV"),
+		"Environment whose glue.<env>.yaml overlays are merged over each configuration file, with its own state file (env GLUEPRINT_ENV)")
 
 	// Cobra also supports local flags, which will only run
 	// when this action is called directly.
 	rootCmd.Flags().BoolP("toggle", "t", false, "Help message for toggle")
 }
+
+// withGlobalOptions adds the paths and variables set with persistent
+// flags to the options for a command
+func withGlobalOptions(opts configmanage.Options) configmanage.Options {
+	opts.ConfigFile = globalOptions.ConfigFile
+	opts.StateFile = globalOptions.StateFile
+	opts.WorkDir = globalOptions.WorkDir
+	opts.Vars = globalOptions.Vars
+	opts.VarFiles = globalOptions.VarFiles
+	opts.Env = globalOptions.Env
+	return opts
+}
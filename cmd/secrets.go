@@ -0,0 +1,118 @@
+/*
+Copyright © 2022 Scott Hawkins <scott@echoboomer.net>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/echoboomer/glueprint/pkg/configmanage"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var secretsFile string
+
+// secretsCmd represents the secrets command
+var secretsCmd = &cobra.Command{
+	Use:   "secrets",
+	Short: "Manage the encrypted secrets file",
+	Long: `Manage the encrypted secrets file kept alongside glue.yaml.
+
+The key is read from the file named by GLUEPRINT_SECRETS_KEY_FILE or,
+if that is not set, derived from GLUEPRINT_SECRETS_PASSPHRASE.`,
+}
+
+// secretsEditCmd represents the secrets edit command
+var secretsEditCmd = &cobra.Command{
+	Use:   "edit",
+	Short: "Edit the encrypted secrets file with $EDITOR",
+	Long:  `Edit the encrypted secrets file with $EDITOR, creating it if it does not exist`,
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return logError(configmanage.EditSecretsFile(secretsFilePath()))
+	},
+}
+
+// secretsEncryptCmd represents the secrets encrypt command
+var secretsEncryptCmd = &cobra.Command{
+	Use:   "encrypt <plaintext file>",
+	Short: "Encrypt a plaintext secrets file",
+	Long:  `Encrypt a plaintext YAML file of secret names and values into the secrets file`,
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return logError(configmanage.EncryptSecretsFile(args[0], secretsFilePath()))
+	},
+}
+
+// secretsDecryptCmd represents the secrets decrypt command
+var secretsDecryptCmd = &cobra.Command{
+	Use:   "decrypt",
+	Short: "Print the decrypted secrets file",
+	Long:  `Print the decrypted secrets file to stdout`,
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return logError(configmanage.DecryptSecretsFile(secretsFilePath(), os.Stdout))
+	},
+}
+
+// secretsKeygenCmd represents the secrets keygen command
+var secretsKeygenCmd = &cobra.Command{
+	Use:   "keygen",
+	Short: "Generate a key for encrypting the secrets file",
+	Long:  `Generate a key for encrypting the secrets file, to be saved to the file named by GLUEPRINT_SECRETS_KEY_FILE`,
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		key, err := configmanage.GenerateSecretsKey()
+		if err != nil {
+			return logError(err)
+		}
+		fmt.Println(key)
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(secretsCmd)
+	secretsCmd.AddCommand(secretsEditCmd, secretsEncryptCmd, secretsDecryptCmd, secretsKeygenCmd)
+
+	secretsCmd.PersistentFlags().StringVar(&secretsFile, "file", "",
+		"Path to the encrypted secrets file (default glue.secrets.enc in the working directory)")
+}
+
+// secretsFilePath returns the secrets file to use, which is resolved
+// once flags are parsed so that it follows --workdir
+func secretsFilePath() string {
+	if secretsFile != "" {
+		return secretsFile
+	}
+	return configmanage.SecretsFilePath(globalOptions.WorkDir)
+}
+
+// logError logs an error from a secrets command, as the root command
+// does not print the errors commands return
+func logError(err error) error {
+	if err != nil {
+		log.Errorf("%s", err)
+	}
+	return err
+}
@@ -31,8 +31,8 @@ var validateCmd = &cobra.Command{
 	Use:   "validate",
 	Short: "Validate configuration files",
 	Long:  `Validate configuration files`,
-	Run: func(cmd *cobra.Command, args []string) {
-		configmanage.Validate()
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return configmanage.Validate(withGlobalOptions(configmanage.Options{}))
 	},
 }
 
@@ -23,6 +23,9 @@ package common
 
 import (
 	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
 
 	"github.com/common-nighthawk/go-figure"
 	"github.com/spf13/afero"
@@ -39,6 +42,19 @@ func DeleteFromSlice(slice []string, selector string) []string {
 	return result
 }
 
+// ExpandHomeDir replaces a leading ~ in the supplied path with the
+// current user's home directory
+func ExpandHomeDir(path string) string {
+	if path != "~" && !strings.HasPrefix(path, "~/") {
+		return path
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return path
+	}
+	return filepath.Join(home, strings.TrimPrefix(path, "~"))
+}
+
 // FileExists returns whether or not the given file exists in the OS
 func FileExists(fs afero.Fs, filename string) bool {
 	_, err := fs.Stat(filename)
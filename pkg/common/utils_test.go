@@ -59,6 +59,41 @@ func TestDeleteFromSlice(t *testing.T) {
 	}
 }
 
+func TestExpandHomeDir(t *testing.T) {
+	t.Setenv("HOME", "/home/glue")
+
+	type args struct {
+		path string
+	}
+	tests := []struct {
+		name string
+		args args
+		want string
+	}{
+		{
+			name: "A path beginning with ~ should be expanded to the home directory",
+			args: args{
+				path: "~/.ssh/id_ed25519",
+			},
+			want: "/home/glue/.ssh/id_ed25519",
+		},
+		{
+			name: "A path without a leading ~ should be returned unchanged",
+			args: args{
+				path: "/etc/ssh/id_ed25519",
+			},
+			want: "/etc/ssh/id_ed25519",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ExpandHomeDir(tt.args.path); got != tt.want {
+				t.Errorf("ExpandHomeDir() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
 func TestFileExists(t *testing.T) {
 	// Mock Vault secret path
 	appFS := afero.NewMemMapFs()
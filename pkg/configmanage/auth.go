@@ -0,0 +1,140 @@
+package configmanage
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"time"
+
+	"github.com/echoboomer/glueprint/pkg/common"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// Supported values for the auth method of a managed resource
+const (
+	authMethodPassword    string = "password"
+	authMethodKey         string = "key"
+	authMethodCertificate string = "certificate"
+	authMethodAgent       string = "agent"
+)
+
+// Suffix OpenSSH gives a certificate issued for a private key
+const certificateFileSuffix string = "-cert.pub"
+
+// newSSHClientConfig builds the client configuration used to connect
+// to a managed resource, along with any connection to an ssh agent that
+// must be closed once the ssh connection is
+func newSSHClientConfig(credentials Credentials) (*ssh.ClientConfig, io.Closer, error) {
+	auth, agentConn, err := sshAuthMethods(credentials)
+	if err != nil {
+		return nil, nil, err
+	}
+	hostKeyCallback, err := newHostKeyCallback(credentials)
+	if err != nil {
+		if agentConn != nil {
+			agentConn.Close()
+		}
+		return nil, nil, err
+	}
+	return &ssh.ClientConfig{
+		User:            credentials.Username,
+		Auth:            auth,
+		HostKeyCallback: hostKeyCallback,
+	}, agentConn, nil
+}
+
+// sshAuthMethods returns the ssh auth methods matching the method
+// chosen for a managed resource. When the agent is used, the connection
+// to it is returned so that it can be closed
+func sshAuthMethods(credentials Credentials) ([]ssh.AuthMethod, io.Closer, error) {
+	switch credentials.AuthMethod {
+	case "", authMethodPassword:
+		return []ssh.AuthMethod{ssh.Password(credentials.Password)}, nil, nil
+	case authMethodKey:
+		signer, err := loadPrivateKey(credentials.KeyFile, credentials.Passphrase)
+		if err != nil {
+			return nil, nil, err
+		}
+		return []ssh.AuthMethod{ssh.PublicKeys(signer)}, nil, nil
+	case authMethodCertificate:
+		signer, err := loadPrivateKey(credentials.KeyFile, credentials.Passphrase)
+		if err != nil {
+			return nil, nil, err
+		}
+		certFile := credentials.CertificateFile
+		if certFile == "" {
+			certFile = credentials.KeyFile + certificateFileSuffix
+		}
+		certSigner, err := loadCertificate(certFile, signer)
+		if err != nil {
+			return nil, nil, err
+		}
+		return []ssh.AuthMethod{ssh.PublicKeys(certSigner)}, nil, nil
+	case authMethodAgent:
+		socket := os.Getenv("SSH_AUTH_SOCK")
+		if socket == "" {
+			return nil, nil, fmt.Errorf("auth method %s requested but SSH_AUTH_SOCK is not set", authMethodAgent)
+		}
+		conn, err := net.Dial("unix", socket)
+		if err != nil {
+			return nil, nil, fmt.Errorf("error connecting to ssh agent: %s", err)
+		}
+		return []ssh.AuthMethod{ssh.PublicKeysCallback(agent.NewClient(conn).Signers)}, conn, nil
+	default:
+		return nil, nil, fmt.Errorf("unknown auth method %s", credentials.AuthMethod)
+	}
+}
+
+// loadPrivateKey reads a private key from disk, decrypting it with the
+// passphrase if one is provided
+func loadPrivateKey(keyFile string, passphrase string) (ssh.Signer, error) {
+	if keyFile == "" {
+		return nil, fmt.Errorf("auth method %s or %s requested but no key was provided", authMethodKey, authMethodCertificate)
+	}
+	pemBytes, err := os.ReadFile(common.ExpandHomeDir(keyFile))
+	if err != nil {
+		return nil, fmt.Errorf("error reading private key: %s", err)
+	}
+	var signer ssh.Signer
+	if passphrase != "" {
+		signer, err = ssh.ParsePrivateKeyWithPassphrase(pemBytes, []byte(passphrase))
+	} else {
+		signer, err = ssh.ParsePrivateKey(pemBytes)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error parsing private key %s: %s", keyFile, err)
+	}
+	return signer, nil
+}
+
+// loadCertificate reads an ssh certificate from disk and pairs it with
+// the private key it was issued for
+func loadCertificate(certFile string, signer ssh.Signer) (ssh.Signer, error) {
+	certBytes, err := os.ReadFile(common.ExpandHomeDir(certFile))
+	if err != nil {
+		return nil, fmt.Errorf("error reading certificate: %s", err)
+	}
+	pub, _, _, _, err := ssh.ParseAuthorizedKey(certBytes)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing certificate %s: %s", certFile, err)
+	}
+	cert, ok := pub.(*ssh.Certificate)
+	if !ok {
+		return nil, fmt.Errorf("%s is a public key, not a certificate", certFile)
+	}
+	if cert.CertType != ssh.UserCert {
+		return nil, fmt.Errorf("%s is not a user certificate", certFile)
+	}
+	// Short lived certificates are the norm, so report expiry clearly
+	// rather than as an authentication failure
+	if cert.ValidBefore != ssh.CertTimeInfinity && time.Now().Unix() >= int64(cert.ValidBefore) {
+		return nil, fmt.Errorf("certificate %s expired at %s", certFile, time.Unix(int64(cert.ValidBefore), 0).Format(time.RFC3339))
+	}
+	certSigner, err := ssh.NewCertSigner(cert, signer)
+	if err != nil {
+		return nil, fmt.Errorf("certificate %s does not match private key: %s", certFile, err)
+	}
+	return certSigner, nil
+}
@@ -0,0 +1,349 @@
+package configmanage
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// writeUserCertificate writes a new private key and a certificate for it
+// signed by ca, returning the path of the key
+func writeUserCertificate(t *testing.T, dir string, ca ssh.Signer, validBefore uint64) string {
+	t.Helper()
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile := filepath.Join(dir, "id_ed25519")
+	writeFile(t, keyFile, string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})))
+
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert := &ssh.Certificate{
+		Key:             signer.PublicKey(),
+		CertType:        ssh.UserCert,
+		KeyId:           "glueprint test",
+		ValidPrincipals: []string{testServerUser},
+		ValidBefore:     validBefore,
+	}
+	if err := cert.SignCert(rand.Reader, ca); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, keyFile+certificateFileSuffix, string(ssh.MarshalAuthorizedKey(cert)))
+	return keyFile
+}
+
+func TestCertificateAuth(t *testing.T) {
+	hostCA := newTestSigner(t)
+	otherCA := newTestSigner(t)
+	server := newTestSSHServerWithHostCA(t, hostCA)
+
+	dir := t.TempDir()
+	hostCAFile := filepath.Join(dir, "host_ca.pub")
+	writeFile(t, hostCAFile, string(ssh.MarshalAuthorizedKey(hostCA.PublicKey())))
+	otherCAFile := filepath.Join(dir, "other_ca.pub")
+	writeFile(t, otherCAFile, string(ssh.MarshalAuthorizedKey(otherCA.PublicKey())))
+
+	tests := []struct {
+		name        string
+		ca          ssh.Signer
+		validBefore uint64
+		hostCAFile  string
+		wantErr     string
+	}{
+		{
+			name:        "A certificate signed by the user CA should authenticate",
+			ca:          server.UserCA,
+			validBefore: ssh.CertTimeInfinity,
+			hostCAFile:  hostCAFile,
+		},
+		{
+			name:        "An expired certificate should be rejected before connecting",
+			ca:          server.UserCA,
+			validBefore: uint64(time.Now().Add(-time.Hour).Unix()),
+			hostCAFile:  hostCAFile,
+			wantErr:     "expired",
+		},
+		{
+			name:        "A certificate signed by another CA should not authenticate",
+			ca:          otherCA,
+			validBefore: ssh.CertTimeInfinity,
+			hostCAFile:  hostCAFile,
+			wantErr:     "unable to authenticate",
+		},
+		{
+			name:        "A host certificate signed by another CA should be rejected",
+			ca:          server.UserCA,
+			validBefore: ssh.CertTimeInfinity,
+			hostCAFile:  otherCAFile,
+			wantErr:     "host certificate",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer connections.closeAll()
+			keyDir := t.TempDir()
+			credentials := Credentials{
+				Hostname:       server.Host,
+				Port:           server.Port,
+				Username:       testServerUser,
+				AuthMethod:     authMethodCertificate,
+				KeyFile:        writeUserCertificate(t, keyDir, tt.ca, tt.validBefore),
+				KnownHostsFile: filepath.Join(keyDir, "known_hosts"),
+				HostCAFile:     tt.hostCAFile,
+				ConnectTimeout: 5 * time.Second,
+			}
+			result, err := RunOnRemoteHost(credentials, "echo ok")
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("RunOnRemoteHost() error = %s", err)
+				}
+				if strings.TrimSpace(result.Stdout) != "ok" {
+					t.Errorf("RunOnRemoteHost() stdout = %q, want %q", result.Stdout, "ok")
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("RunOnRemoteHost() error = %v, want error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// writePrivateKey writes a new RSA private key in PEM form, encrypted
+// with passphrase if one is given, and returns its path
+func writePrivateKey(t *testing.T, dir string, passphrase string) string {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block := &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}
+	if passphrase != "" {
+		//lint:ignore SA1019 OpenSSH still reads legacy encrypted PEM keys
+		block, err = x509.EncryptPEMBlock(rand.Reader, block.Type, block.Bytes, []byte(passphrase), x509.PEMCipherAES128)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	keyFile := filepath.Join(dir, "id_rsa")
+	writeFile(t, keyFile, string(pem.EncodeToMemory(block)))
+	return keyFile
+}
+
+func TestLoadPrivateKey(t *testing.T) {
+	dir := t.TempDir()
+	plainKey := writePrivateKey(t, dir, "")
+	encryptedDir := filepath.Join(dir, "encrypted")
+	if err := os.Mkdir(encryptedDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	encryptedKey := writePrivateKey(t, encryptedDir, "hunter2")
+
+	tests := []struct {
+		name       string
+		keyFile    string
+		passphrase string
+		wantErr    string
+	}{
+		{
+			name:    "A key should load",
+			keyFile: plainKey,
+		},
+		{
+			name:    "No key should be an error",
+			keyFile: "",
+			wantErr: "no key was provided",
+		},
+		{
+			name:    "A missing key should be an error",
+			keyFile: filepath.Join(dir, "id_missing"),
+			wantErr: "error reading private key",
+		},
+		{
+			name:    "An encrypted key without a passphrase should be an error",
+			keyFile: encryptedKey,
+			wantErr: "passphrase protected",
+		},
+		{
+			name:       "An encrypted key with the wrong passphrase should be an error",
+			keyFile:    encryptedKey,
+			passphrase: "hunter3",
+			wantErr:    "error parsing private key",
+		},
+		{
+			name:       "An encrypted key with its passphrase should load",
+			keyFile:    encryptedKey,
+			passphrase: "hunter2",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			signer, err := loadPrivateKey(tt.keyFile, tt.passphrase)
+			if tt.wantErr == "" {
+				if err != nil || signer == nil {
+					t.Errorf("loadPrivateKey() = %v, %v, want a signer", signer, err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("loadPrivateKey() error = %v, want error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestSSHAuthMethods(t *testing.T) {
+	keyFile := writePrivateKey(t, t.TempDir(), "")
+
+	tests := []struct {
+		name        string
+		credentials Credentials
+		authSock    string
+		wantMethods int
+		wantErr     string
+	}{
+		{
+			name:        "Password auth should be used by default",
+			credentials: Credentials{Password: "glue"},
+			wantMethods: 1,
+		},
+		{
+			name:        "Key auth should use the key",
+			credentials: Credentials{AuthMethod: authMethodKey, KeyFile: keyFile},
+			wantMethods: 1,
+		},
+		{
+			name:        "Key auth with a missing key should be an error",
+			credentials: Credentials{AuthMethod: authMethodKey, KeyFile: keyFile + ".missing"},
+			wantErr:     "error reading private key",
+		},
+		{
+			name:        "Certificate auth without a certificate should be an error",
+			credentials: Credentials{AuthMethod: authMethodCertificate, KeyFile: keyFile},
+			wantErr:     "error reading certificate",
+		},
+		{
+			name:        "Agent auth with SSH_AUTH_SOCK unset should be an error",
+			credentials: Credentials{AuthMethod: authMethodAgent},
+			authSock:    "",
+			wantErr:     "SSH_AUTH_SOCK is not set",
+		},
+		{
+			name:        "Agent auth with no agent listening should be an error",
+			credentials: Credentials{AuthMethod: authMethodAgent},
+			authSock:    filepath.Join(t.TempDir(), "agent.sock"),
+			wantErr:     "error connecting to ssh agent",
+		},
+		{
+			name:        "An unknown auth method should be an error",
+			credentials: Credentials{AuthMethod: "kerberos"},
+			wantErr:     "unknown auth method kerberos",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("SSH_AUTH_SOCK", tt.authSock)
+			methods, closer, err := sshAuthMethods(tt.credentials)
+			if closer != nil {
+				closer.Close()
+			}
+			if tt.wantErr == "" {
+				if err != nil || len(methods) != tt.wantMethods {
+					t.Errorf("sshAuthMethods() = %d methods, %v, want %d methods", len(methods), err, tt.wantMethods)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("sshAuthMethods() error = %v, want error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestAgentAuthClosesAgentConnection(t *testing.T) {
+	server := newTestSSHServer(t)
+
+	// An agent holding a key the test server accepts - the agent in this
+	// version of x/crypto can't sign with certificates or ed25519 keys
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.AuthorizeKey(signer.PublicKey())
+	keyring := agent.NewKeyring()
+	if err := keyring.Add(agent.AddedKey{PrivateKey: key}); err != nil {
+		t.Fatal(err)
+	}
+
+	socket := filepath.Join(t.TempDir(), "agent.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	closed := make(chan struct{}, 1)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				_ = agent.ServeAgent(keyring, conn)
+				closed <- struct{}{}
+			}()
+		}
+	}()
+	t.Setenv("SSH_AUTH_SOCK", socket)
+
+	credentials := Credentials{
+		Hostname:       server.Host,
+		Port:           server.Port,
+		Username:       testServerUser,
+		AuthMethod:     authMethodAgent,
+		KnownHostsFile: server.KnownHosts,
+		ConnectTimeout: 5 * time.Second,
+	}
+	result, err := RunOnRemoteHost(credentials, "echo ok")
+	if err != nil {
+		connections.closeAll()
+		t.Fatalf("RunOnRemoteHost() error = %s", err)
+	}
+	if strings.TrimSpace(result.Stdout) != "ok" {
+		t.Errorf("RunOnRemoteHost() stdout = %q, want %q", result.Stdout, "ok")
+	}
+	select {
+	case <-closed:
+		t.Fatal("agent connection closed while the ssh connection is open")
+	default:
+	}
+
+	connections.closeAll()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Error("agent connection was not closed with the ssh connection")
+	}
+}
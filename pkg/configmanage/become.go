@@ -0,0 +1,83 @@
+package configmanage
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// becomeTransport escalates everything it runs on a host through sudo,
+// for resources that log in as an unprivileged user
+type becomeTransport struct {
+	Transport
+	password string
+}
+
+// Run executes a command through sudo
+func (t *becomeTransport) Run(command string, stdin io.Reader) (CommandResult, error) {
+	command, sudoInput := becomeCommand(t.password, command)
+	if sudoInput != nil {
+		if stdin != nil {
+			stdin = io.MultiReader(sudoInput, stdin)
+		} else {
+			stdin = sudoInput
+		}
+	}
+	return t.Transport.Run(command, stdin)
+}
+
+// PutFile stages content in a private temporary file owned by the login
+// user and writes it into place with elevated rights. An existing file
+// is overwritten in place so that it keeps its owner and mode, while a
+// new file is created owned by root and readable by everyone
+func (t *becomeTransport) PutFile(path string, content io.Reader) (int64, error) {
+	result, err := t.Transport.Run("mktemp /tmp/glueprint.XXXXXX", nil)
+	if err != nil {
+		return 0, fmt.Errorf("error creating temporary file on host: %s", err)
+	}
+	tmpPath := strings.TrimSpace(result.Stdout)
+	// The staged file may hold a secret, so it is removed whether or not
+	// it made it into place
+	defer func() {
+		_, _ = t.Transport.Run(fmt.Sprintf("rm -f %s", shellQuote(tmpPath)), nil)
+	}()
+
+	bytes, err := t.Transport.PutFile(tmpPath, content)
+	if err != nil {
+		return 0, err
+	}
+
+	command := fmt.Sprintf("if [ -e %[2]s ]; then cat %[1]s > %[2]s; else install -o root -g root -m 0644 %[1]s %[2]s; fi",
+		shellQuote(tmpPath), shellQuote(path))
+	_, err = t.Run(command, nil)
+	if err != nil {
+		return 0, fmt.Errorf("error writing file into place on host: %s", err)
+	}
+	return bytes, nil
+}
+
+// GetFile reads a file with elevated rights
+func (t *becomeTransport) GetFile(path string) ([]byte, error) {
+	result, err := t.Run(fmt.Sprintf("cat %s", shellQuote(path)), nil)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(result.Stdout), nil
+}
+
+// becomeCommand wraps a command in sudo and returns any input sudo
+// expects on stdin
+func becomeCommand(password string, command string) (string, io.Reader) {
+	if password == "" {
+		// Fail rather than hang if sudo unexpectedly prompts
+		return fmt.Sprintf("sudo -n sh -c %s", shellQuote(command)), nil
+	}
+	// Read the password from stdin without printing a prompt
+	return fmt.Sprintf("sudo -S -p '' sh -c %s", shellQuote(command)), strings.NewReader(password + "\n")
+}
+
+// shellQuote wraps a string in single quotes so that it is passed to
+// the shell as a single argument
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'"'"'`) + "'"
+}
@@ -0,0 +1,354 @@
+package configmanage
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/pkg/sftp"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+)
+
+// connectionManager dials each host once and shares the connection
+// between all sessions and sftp transfers made during a run
+type connectionManager struct {
+	mu          sync.Mutex
+	clients     map[string]*ssh.Client
+	sftpClients map[string]*sftp.Client
+	// Order in which clients were dialed, so that connections tunnelled
+	// through a bastion are closed before the bastion itself
+	dialOrder []string
+}
+
+// connections holds the connections opened by the current run
+var connections = newConnectionManager()
+
+// The delay before the first retry of a failed dial, doubled after each
+// further attempt
+var retryBackoff time.Duration = time.Second
+
+// sleep waits between dial attempts
+var sleep = time.Sleep
+
+func newConnectionManager() *connectionManager {
+	return &connectionManager{
+		clients:     map[string]*ssh.Client{},
+		sftpClients: map[string]*sftp.Client{},
+	}
+}
+
+// hostAddress returns the address used to dial a managed resource
+func hostAddress(credentials Credentials) string {
+	return net.JoinHostPort(credentials.Hostname, strconv.Itoa(credentials.Port))
+}
+
+// connectionKey identifies a connection by login user, address and the
+// chain of bastions it is reached through
+func connectionKey(credentials Credentials) string {
+	key := strings.Join([]string{credentials.Username, hostAddress(credentials)}, "@")
+	if credentials.Bastion != nil {
+		key = strings.Join([]string{key, connectionKey(*credentials.Bastion)}, " via ")
+	}
+	return key
+}
+
+// client returns the ssh connection for a host, dialing it if this is
+// the first time it has been requested
+func (m *connectionManager) client(credentials Credentials) (*ssh.Client, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.clientLocked(credentials)
+}
+
+// clientLocked returns the ssh connection for a host, dialing through
+// any bastions first - the caller must hold the lock
+func (m *connectionManager) clientLocked(credentials Credentials) (*ssh.Client, error) {
+	key := connectionKey(credentials)
+	if client, ok := m.clients[key]; ok {
+		return client, nil
+	}
+
+	config, agentConn, err := newSSHClientConfig(credentials)
+	if err != nil {
+		return nil, err
+	}
+
+	var client *ssh.Client
+	if credentials.Bastion == nil {
+		client, err = dialWithRetry(credentials, func() (net.Conn, error) {
+			return net.DialTimeout("tcp", hostAddress(credentials), credentials.ConnectTimeout)
+		}, config)
+	} else {
+		var bastionClient *ssh.Client
+		bastionClient, err = m.clientLocked(*credentials.Bastion)
+		if err != nil {
+			err = fmt.Errorf("error connecting to bastion %s: %s", credentials.Bastion.Hostname, err)
+		} else {
+			client, err = dialWithRetry(credentials, func() (net.Conn, error) {
+				return bastionClient.Dial("tcp", hostAddress(credentials))
+			}, config)
+		}
+	}
+	if err != nil {
+		if agentConn != nil {
+			agentConn.Close()
+		}
+		return nil, err
+	}
+	if agentConn != nil {
+		// The agent connection lives as long as the ssh connection, however
+		// that ends
+		go func() {
+			_ = client.Wait()
+			agentConn.Close()
+		}()
+	}
+	m.clients[key] = client
+	m.dialOrder = append(m.dialOrder, key)
+	go m.keepalive(key, client, credentials.KeepaliveInterval)
+	return client, nil
+}
+
+// dialWithRetry establishes an ssh connection over the network connection
+// returned by dial, retrying transient failures with exponential backoff
+func dialWithRetry(credentials Credentials, dial func() (net.Conn, error), config *ssh.ClientConfig) (*ssh.Client, error) {
+	backoff := retryBackoff
+	for attempt := 0; ; attempt++ {
+		client, err := dialSSH(dial, hostAddress(credentials), config, credentials.ConnectTimeout)
+		if err == nil {
+			return client, nil
+		}
+		if attempt >= credentials.Retries || !isTransientDialError(err) {
+			return nil, err
+		}
+		log.Warnf("Error connecting to %s, retrying in %s: %s", hostAddress(credentials), backoff, err)
+		sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// dialSSH performs the ssh handshake over a new network connection,
+// bounding it by the connect timeout
+func dialSSH(dial func() (net.Conn, error), address string, config *ssh.ClientConfig, timeout time.Duration) (*ssh.Client, error) {
+	netConn, err := dial()
+	if err != nil {
+		return nil, err
+	}
+	conn := &recordingConn{Conn: netConn}
+	if timeout > 0 {
+		_ = conn.SetDeadline(time.Now().Add(timeout))
+	}
+	// Note when the host key is reached, as failures from then on are
+	// the host's answer rather than a broken connection
+	reachedHostKey := false
+	handshakeConfig := *config
+	handshakeConfig.HostKeyCallback = func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		reachedHostKey = true
+		return config.HostKeyCallback(hostname, remote, key)
+	}
+	clientConn, chans, reqs, err := ssh.NewClientConn(conn, address, &handshakeConfig)
+	if err != nil {
+		conn.Close()
+		// The ssh package flattens the error that broke the connection
+		// into its message, so return that error itself when there is one
+		if !reachedHostKey && conn.recorded() != nil {
+			return nil, &handshakeError{message: err.Error(), cause: conn.recorded()}
+		}
+		return nil, err
+	}
+	_ = conn.SetDeadline(time.Time{})
+	return ssh.NewClient(clientConn, chans, reqs), nil
+}
+
+// recordingConn keeps the first error reading from or writing to a
+// network connection
+type recordingConn struct {
+	net.Conn
+	mu  sync.Mutex
+	err error
+}
+
+func (c *recordingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.record(err)
+	return n, err
+}
+
+func (c *recordingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.record(err)
+	return n, err
+}
+
+func (c *recordingConn) record(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err != nil && c.err == nil {
+		c.err = err
+	}
+}
+
+func (c *recordingConn) recorded() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
+// handshakeError is an ssh handshake that failed because the network
+// connection under it did
+type handshakeError struct {
+	message string
+	cause   error
+}
+
+func (e *handshakeError) Error() string {
+	return e.message
+}
+
+func (e *handshakeError) Unwrap() error {
+	return e.cause
+}
+
+// isTransientDialError reports whether a failed dial is worth retrying -
+// network errors, bastions failing to reach a host and connections
+// dropped during the handshake, as sshd does when MaxStartups is
+// exceeded, are retried while authentication and host key failures are
+// not
+func isTransientDialError(err error) bool {
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+	var channelErr *ssh.OpenChannelError
+	if errors.As(err, &channelErr) {
+		return channelErr.Reason == ssh.ConnectionFailed
+	}
+	return errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, syscall.ECONNRESET)
+}
+
+// keepalive periodically sends keepalive requests over a connection so
+// that long running commands are not dropped by idle timeouts, and
+// forgets the connection once the host stops responding so that the
+// next operation redials it
+func (m *connectionManager) keepalive(key string, client *ssh.Client, interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		_, _, err := client.SendRequest("keepalive@openssh.com", true, nil)
+		if err == nil {
+			continue
+		}
+		m.mu.Lock()
+		if m.clients[key] == client {
+			log.Warnf("Connection to %s lost: %s", key, err)
+			m.forgetLocked(key)
+		}
+		m.mu.Unlock()
+		client.Close()
+		return
+	}
+}
+
+// reset closes and forgets the connection for a host so that the next
+// operation redials it
+func (m *connectionManager) reset(credentials Credentials) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key := connectionKey(credentials)
+	if client, ok := m.clients[key]; ok {
+		client.Close()
+	}
+	m.forgetLocked(key)
+}
+
+// forgetLocked removes a connection and its sftp session from the
+// manager, closing and removing any connections tunnelled through it -
+// the caller must hold the lock
+func (m *connectionManager) forgetLocked(key string) {
+	var dependents []string
+	for _, k := range m.dialOrder {
+		if strings.HasSuffix(k, " via "+key) {
+			dependents = append(dependents, k)
+		}
+	}
+	for _, k := range dependents {
+		if client, ok := m.clients[k]; ok {
+			client.Close()
+		}
+		m.forgetOneLocked(k)
+	}
+	m.forgetOneLocked(key)
+}
+
+// forgetOneLocked removes a single connection and its sftp session from
+// the manager - the caller must hold the lock
+func (m *connectionManager) forgetOneLocked(key string) {
+	if sftpClient, ok := m.sftpClients[key]; ok {
+		sftpClient.Close()
+		delete(m.sftpClients, key)
+	}
+	delete(m.clients, key)
+	for i, k := range m.dialOrder {
+		if k == key {
+			m.dialOrder = append(m.dialOrder[:i], m.dialOrder[i+1:]...)
+			break
+		}
+	}
+}
+
+// sftpClient returns the sftp subsystem for a host, starting it over the
+// shared ssh connection if this is the first time it has been requested
+func (m *connectionManager) sftpClient(credentials Credentials) (*sftp.Client, error) {
+	client, err := m.client(credentials)
+	if err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key := connectionKey(credentials)
+	if sftpClient, ok := m.sftpClients[key]; ok {
+		return sftpClient, nil
+	}
+
+	sftpClient, err := sftp.NewClient(client)
+	if err != nil {
+		return nil, err
+	}
+	m.sftpClients[key] = sftpClient
+	return sftpClient, nil
+}
+
+// closeAll closes every connection opened during the run
+func (m *connectionManager) closeAll() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for key, sftpClient := range m.sftpClients {
+		if err := sftpClient.Close(); err != nil {
+			log.Errorf("Error closing sftp session to %s: %s", key, err)
+		}
+		delete(m.sftpClients, key)
+	}
+	for i := len(m.dialOrder) - 1; i >= 0; i-- {
+		key := m.dialOrder[i]
+		if err := m.clients[key].Close(); err != nil {
+			log.Errorf("Error closing connection to %s: %s", key, err)
+		}
+		delete(m.clients, key)
+	}
+	m.dialOrder = nil
+}
@@ -0,0 +1,310 @@
+package configmanage
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// newDroppingListener accepts connections in front of target, closing
+// the first drops of them straight away and forwarding the rest
+func newDroppingListener(t *testing.T, target string, drops int) (string, int) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	forward(t, listener, target, drops)
+	addr := listener.Addr().(*net.TCPAddr)
+	return addr.IP.String(), addr.Port
+}
+
+// forward passes connections accepted by listener on to target, closing
+// the first drops of them straight away
+func forward(t *testing.T, listener net.Listener, target string, drops int) {
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for accepted := 0; ; accepted++ {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			if accepted < drops {
+				conn.Close()
+				continue
+			}
+			go func() {
+				defer conn.Close()
+				upstream, err := net.Dial("tcp", target)
+				if err != nil {
+					return
+				}
+				defer upstream.Close()
+				go func() {
+					_, _ = io.Copy(upstream, conn)
+					upstream.Close()
+				}()
+				_, _ = io.Copy(conn, upstream)
+			}()
+		}
+	}()
+}
+
+// newSilentListener accepts connections and never answers them
+func newSilentListener(t *testing.T) (string, int) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var mu sync.Mutex
+	var conns []net.Conn
+	t.Cleanup(func() {
+		listener.Close()
+		mu.Lock()
+		defer mu.Unlock()
+		for _, conn := range conns {
+			conn.Close()
+		}
+	})
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			conns = append(conns, conn)
+			mu.Unlock()
+		}
+	}()
+	addr := listener.Addr().(*net.TCPAddr)
+	return addr.IP.String(), addr.Port
+}
+
+// recordSleeps replaces the wait between dial attempts for a test and
+// returns the delays that were asked for
+func recordSleeps(t *testing.T) *[]time.Duration {
+	t.Helper()
+	previousBackoff, previousSleep := retryBackoff, sleep
+	t.Cleanup(func() { retryBackoff, sleep = previousBackoff, previousSleep })
+	var sleeps []time.Duration
+	retryBackoff = 10 * time.Millisecond
+	sleep = func(d time.Duration) { sleeps = append(sleeps, d) }
+	return &sleeps
+}
+
+func TestDialWithRetry(t *testing.T) {
+	server := newTestSSHServer(t)
+	target := net.JoinHostPort(server.Host, fmt.Sprint(server.Port))
+
+	tests := []struct {
+		name       string
+		drops      int
+		retries    int
+		password   string
+		wantErr    bool
+		wantSleeps []time.Duration
+	}{
+		{
+			name:       "Dropped connections should be retried with exponential backoff",
+			drops:      2,
+			retries:    3,
+			password:   testServerPassword,
+			wantSleeps: []time.Duration{10 * time.Millisecond, 20 * time.Millisecond},
+		},
+		{
+			name:       "Retries should stop once they are used up",
+			drops:      3,
+			retries:    2,
+			password:   testServerPassword,
+			wantErr:    true,
+			wantSleeps: []time.Duration{10 * time.Millisecond, 20 * time.Millisecond},
+		},
+		{
+			name:     "Authentication failures should not be retried",
+			retries:  3,
+			password: "wrong",
+			wantErr:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sleeps := recordSleeps(t)
+			host, port := newDroppingListener(t, target, tt.drops)
+			// The server's key is trusted under its own address only
+			credentials := Credentials{
+				Hostname:        host,
+				Port:            port,
+				Username:        testServerUser,
+				Password:        tt.password,
+				KnownHostsFile:  server.KnownHosts,
+				TrustOnFirstUse: true,
+				ConnectTimeout:  5 * time.Second,
+				Retries:         tt.retries,
+			}
+			m := newConnectionManager()
+			defer m.closeAll()
+
+			_, err := m.client(credentials)
+			if tt.wantErr && err == nil {
+				t.Fatal("client() error = nil, want an error")
+			}
+			if !tt.wantErr && err != nil {
+				t.Fatalf("client() error = %s", err)
+			}
+			if !reflect.DeepEqual(*sleeps, tt.wantSleeps) {
+				t.Errorf("client() waited %v, want %v", *sleeps, tt.wantSleeps)
+			}
+		})
+	}
+}
+
+func TestDialTimeout(t *testing.T) {
+	sleeps := recordSleeps(t)
+	host, port := newSilentListener(t)
+	credentials := Credentials{
+		Hostname:        host,
+		Port:            port,
+		Username:        testServerUser,
+		Password:        testServerPassword,
+		KnownHostsFile:  filepath.Join(t.TempDir(), "known_hosts"),
+		TrustOnFirstUse: true,
+		ConnectTimeout:  100 * time.Millisecond,
+		Retries:         1,
+	}
+	m := newConnectionManager()
+	defer m.closeAll()
+
+	start := time.Now()
+	_, err := m.client(credentials)
+	if err == nil {
+		t.Fatal("client() error = nil, want a timeout")
+	}
+	var netErr net.Error
+	if !errors.As(err, &netErr) || !netErr.Timeout() {
+		t.Errorf("client() error = %s, want a timeout", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("client() took %s, want it bounded by the connect timeout", elapsed)
+	}
+	if want := []time.Duration{10 * time.Millisecond}; !reflect.DeepEqual(*sleeps, want) {
+		t.Errorf("client() waited %v, want %v", *sleeps, want)
+	}
+}
+
+func TestIsTransientDialError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{
+			name: "Network errors should be retried",
+			err:  &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")},
+			want: true,
+		},
+		{
+			name: "A connection closed during the handshake should be retried",
+			err:  &handshakeError{message: "ssh: handshake failed: EOF", cause: io.EOF},
+			want: true,
+		},
+		{
+			name: "A bastion failing to reach the host should be retried",
+			err:  &ssh.OpenChannelError{Reason: ssh.ConnectionFailed, Message: "connection refused"},
+			want: true,
+		},
+		{
+			name: "A bastion refusing to forward should not be retried",
+			err:  &ssh.OpenChannelError{Reason: ssh.Prohibited, Message: "administratively prohibited"},
+			want: false,
+		},
+		{
+			name: "Authentication failures should not be retried",
+			err:  errors.New("ssh: handshake failed: ssh: unable to authenticate, attempted methods [none password], no supported methods remain"),
+			want: false,
+		},
+		{
+			name: "Messages that merely mention EOF should not be retried",
+			err:  errors.New("ssh: handshake failed: host key mismatch near EOF"),
+			want: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isTransientDialError(tt.err); got != tt.want {
+				t.Errorf("isTransientDialError() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestKeepaliveForgetsTunnelledConnections(t *testing.T) {
+	bastionServer := newTestSSHServer(t)
+	server := newTestSSHServer(t)
+	bastion := Credentials{
+		Hostname:          bastionServer.Host,
+		Port:              bastionServer.Port,
+		Username:          testServerUser,
+		Password:          testServerPassword,
+		KnownHostsFile:    bastionServer.KnownHosts,
+		ConnectTimeout:    5 * time.Second,
+		KeepaliveInterval: 10 * time.Millisecond,
+	}
+	// Without a keepalive of its own, the tunnelled connection is only
+	// dropped along with the bastion
+	credentials := Credentials{
+		Hostname:       server.Host,
+		Port:           server.Port,
+		Username:       testServerUser,
+		Password:       testServerPassword,
+		KnownHostsFile: server.KnownHosts,
+		ConnectTimeout: 5 * time.Second,
+		Bastion:        &bastion,
+	}
+	m := newConnectionManager()
+	defer m.closeAll()
+
+	client, err := m.client(credentials)
+	if err != nil {
+		t.Fatalf("client() error = %s", err)
+	}
+	m.mu.Lock()
+	bastionClient := m.clients[connectionKey(bastion)]
+	m.mu.Unlock()
+	bastionClient.Close()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		m.mu.Lock()
+		remaining := len(m.clients)
+		m.mu.Unlock()
+		if remaining == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("keepalive left %d connections after the bastion was lost", remaining)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, _, err := client.SendRequest("keepalive@openssh.com", true, nil); err == nil {
+		t.Error("connection through the lost bastion is still open")
+	}
+
+	// The next operation redials the bastion and the host behind it
+	redialed, err := m.client(credentials)
+	if err != nil {
+		t.Fatalf("client() error = %s", err)
+	}
+	if redialed == client {
+		t.Error("client() returned the stale connection")
+	}
+}
@@ -9,113 +9,161 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
-func Deploy() {
-	parsedFileContents, err := parseConfigurationFile()
+// Deploy applies changes to managed resources and records them in state
+func Deploy(opts Options) error {
+	parsedFileContents, err := parseConfigurationFile(opts)
 	if err != nil {
-		log.Error(err)
+		logErrors(err)
+		return err
 	}
 
-	// Validate discovered components
-	var validates bool
+	// Connections are reused for every operation on a host and closed
+	// once all resources have been processed
+	defer connections.closeAll()
+
+	// Validate discovered components, reporting every problem found
+	// before giving up
+	var errs errorList
 	for _, obj := range parsedFileContents {
-		validates = validateManagedResources(obj, true)
+		errs = append(errs, validateManagedResources(obj, true)...)
+	}
+	if len(errs) > 0 {
+		logErrors(errs)
+		return errs
 	}
 
 	// Iterate over discovered components
-	if validates {
-		for _, obj := range parsedFileContents {
-			for k, v := range obj {
-				credentials := Credentials{
-					Hostname: v.Host,
-					Username: "root",
-					Password: v.Password,
-				}
+	for _, obj := range parsedFileContents {
+		for k, v := range obj {
+			credentials, err := newCredentials(v)
+			if err != nil {
+				log.Errorf("Error connecting to %s: %s", k, err)
+				continue
+			}
+			credentials.Stream = opts.Stream
+			transport, err := newTransport(credentials)
+			if err != nil {
+				log.Errorf("Error connecting to %s: %s", k, err)
+				continue
+			}
 
-				_, err := emoji.Printf(":package: Applying configuration for %s\n", k)
-				if err != nil {
-					log.Fatal(err)
-				}
+			_, err = emoji.Printf(":package: Applying configuration for %s\n", k)
+			if err != nil {
+				log.Fatal(err)
+			}
 
-				// If the resource exists in state, we must compare it
-				// Otherwise, it doesn't exist and should be created
-				fromState := ReadOneFromState(k)
+			// If the resource exists in state, we must compare it
+			// Otherwise, it doesn't exist and should be created
+			fromState := ReadOneFromState(opts.stateFile(), k)
 
-				var resourceExistsInState bool
-				if fromState[k].Host == v.Host {
-					resourceExistsInState = true
-				} else {
-					resourceExistsInState = false
-				}
-				if resourceExistsInState {
-					// Establish diffs
-					// Packages
-					packageDiffs := GetPackageDiffs(credentials, v.Packages, fromState[k])
-					if len(packageDiffs) != 0 {
-						for _, diff := range packageDiffs {
-							switch diff.Operation {
-							case "INSTALL":
-								InstallPackage(credentials, diff.PackageResource)
-							case "REMOVE":
-								RemovePackage(credentials, diff.PackageResource)
+			var resourceExistsInState bool
+			if fromState[k].Host == v.Host {
+				resourceExistsInState = true
+			} else {
+				resourceExistsInState = false
+			}
+			// State is only written for a host once every change to it
+			// has been applied
+			failed := false
+			if resourceExistsInState {
+				// Establish diffs
+				// Packages
+				packageDiffs, err := GetPackageDiffs(transport, v.Packages, fromState[k])
+				if err != nil {
+					log.Errorf("Error checking packages on %s: %s", k, err)
+					failed = true
+				} else if len(packageDiffs) != 0 {
+					for _, diff := range packageDiffs {
+						switch diff.Operation {
+						case "INSTALL":
+							if err := InstallPackage(transport, diff.PackageResource); err != nil {
+								failed = true
+							}
+						case "REMOVE":
+							if err := RemovePackage(transport, diff.PackageResource); err != nil {
+								failed = true
 							}
 						}
-					} else {
-						log.Info("All packages are up to date\n")
 					}
-					// Files
-					fileDiffs := GetFileDiffs(credentials, v.Files, fromState[k])
-					if len(fileDiffs) != 0 {
-						for _, diff := range fileDiffs {
-							switch diff.Operation {
-							case "CREATE":
-								err := UploadFileViaSFTP(credentials, diff.FileResource)
-								if err != nil {
-									log.Errorf("Error copying file to host: %s", err)
-								}
-							case "REPLACE":
-								DeleteFile(credentials, diff.FileResource)
-								err := UploadFileViaSFTP(credentials, diff.FileResource)
-								if err != nil {
-									log.Errorf("Error copying file to host: %s", err)
-								}
-							case "UPDATE":
-								UpdateFileMode(credentials, diff.FileResource)
-							case "DELETE":
-								DeleteFile(credentials, diff.FileResource)
+				} else {
+					log.Info("All packages are up to date\n")
+				}
+				// Files
+				fileDiffs := GetFileDiffs(transport, v.Files, fromState[k])
+				if len(fileDiffs) != 0 {
+					for _, diff := range fileDiffs {
+						switch diff.Operation {
+						case "CREATE":
+							err := UploadFile(transport, diff.FileResource)
+							if err != nil {
+								log.Errorf("Error copying file to host: %s", err)
+								failed = true
+							}
+						case "REPLACE":
+							// The upload overwrites the file, so only its
+							// result matters
+							_ = DeleteFile(transport, diff.FileResource)
+							err := UploadFile(transport, diff.FileResource)
+							if err != nil {
+								log.Errorf("Error copying file to host: %s", err)
+								failed = true
+							}
+						case "UPDATE":
+							if diff.Target == "Owner" {
+								err = UpdateFileOwner(transport, diff.FileResource)
+							} else {
+								err = UpdateFileMode(transport, diff.FileResource)
+							}
+							if err != nil {
+								failed = true
+							}
+						case "DELETE":
+							if err := DeleteFile(transport, diff.FileResource); err != nil {
+								failed = true
 							}
 						}
-					} else {
-						log.Info("All files are up to date\n")
 					}
-					fmt.Println()
 				} else {
-					// Instantiate a new resource
-					// Packages
-					for _, pkg := range v.Packages {
-						InstallPackage(credentials, pkg)
-					}
-					// Files
-					for _, file := range v.Files {
-						err := UploadFileViaSFTP(credentials, file)
-						if err != nil {
-							log.Errorf("Error copying file to host: %s", err)
-						}
+					log.Info("All files are up to date\n")
+				}
+				fmt.Println()
+			} else {
+				// Instantiate a new resource
+				// Packages
+				for _, pkg := range v.Packages {
+					if err := InstallPackage(transport, pkg); err != nil {
+						failed = true
 					}
 				}
-				if len(v.Command) != 0 {
-					// Run any commands
-					command := strings.Join(v.Command, " ")
-					result, err := RunOnRemoteHost(credentials, command)
+				// Files
+				for _, file := range v.Files {
+					err := UploadFile(transport, file)
 					if err != nil {
-						log.Errorf("Error executing command: %s", err)
+						log.Errorf("Error copying file to host: %s", err)
+						failed = true
 					}
-					log.Infof("Running command on host...")
-					fmt.Println(result)
 				}
 			}
+			if len(v.Command) != 0 {
+				// Run any commands
+				command := strings.Join(v.Command, " ")
+				log.Infof("Running command on host...")
+				result, err := transport.Run(command, nil)
+				if err != nil {
+					log.Errorf("Error executing command: %s", err)
+					failed = true
+				}
+				printOutput(result)
+			}
+
 			// Write to state
-			WriteToState(obj)
-			color.Green("Deploy complete!")
+			if failed {
+				log.Errorf("Changes to %s were not all applied, its state has not been updated", k)
+				continue
+			}
+			WriteToState(opts.stateFile(), map[string]ManagedResource{k: v})
 		}
+		color.Green("Deploy complete!")
 	}
+	return nil
 }
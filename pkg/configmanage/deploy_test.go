@@ -0,0 +1,228 @@
+package configmanage
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// chdir changes the working directory for the duration of a test
+func chdir(t *testing.T, dir string) {
+	t.Helper()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		os.Chdir(wd)
+	})
+}
+
+// writeFile writes a file for a test, failing it on error
+func writeFile(t *testing.T, path string, content string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestProposeAndDeploy(t *testing.T) {
+	server := newTestSSHServer(t)
+	htmlDir := filepath.Join(server.Root, "var", "www", "html")
+	if err := os.MkdirAll(htmlDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	remoteIndex := filepath.Join(htmlDir, "index.php")
+	restarted := filepath.Join(server.Root, "restarted")
+
+	chdir(t, t.TempDir())
+	writeFile(t, "index.php", "<?php phpinfo(); ?>\n")
+	writeFile(t, watchedFileName, "web:\n"+server.testConfig()+fmt.Sprintf(`  files:
+    - name: index.php
+      path: %s
+      mode: 0600
+  packages:
+    - package: apache2
+    - package: php
+      version: 2:8.1
+  command: ['touch', '%s']
+`, htmlDir, restarted))
+
+	// Proposing changes must not touch the host
+	if err := Propose(Options{}); err != nil {
+		t.Fatalf("Propose() error = %s", err)
+	}
+	if _, err := os.Stat(remoteIndex); !os.IsNotExist(err) {
+		t.Fatalf("Propose() created %s on host", remoteIndex)
+	}
+	if got := server.Packages(t); got != "" {
+		t.Fatalf("Propose() installed packages on host: %q", got)
+	}
+
+	if err := Deploy(Options{}); err != nil {
+		t.Fatalf("Deploy() error = %s", err)
+	}
+
+	content, err := os.ReadFile(remoteIndex)
+	if err != nil {
+		t.Fatalf("Deploy() did not upload index.php: %s", err)
+	}
+	if string(content) != "<?php phpinfo(); ?>\n" {
+		t.Errorf("Deploy() uploaded %q, want %q", content, "<?php phpinfo(); ?>\n")
+	}
+	if got, want := server.Packages(t), "apache2 1.0\nphp 2:8.1\n"; got != want {
+		t.Errorf("Deploy() installed packages %q, want %q", got, want)
+	}
+	if _, err := os.Stat(restarted); err != nil {
+		t.Errorf("Deploy() did not run the after-deploy command: %s", err)
+	}
+	if _, ok := ReadOneFromState(stateFileName, "web")["web"]; !ok {
+		t.Errorf("Deploy() did not record web in state")
+	}
+
+	// Once deployed, the host should match the configuration
+	parsedFileContents, err := parseConfigurationFile(Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resource := parsedFileContents[0]["web"]
+	fromState := ReadOneFromState(stateFileName, "web")["web"]
+	credentials, err := newCredentials(resource)
+	if err != nil {
+		t.Fatal(err)
+	}
+	transport, err := newTransport(credentials)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer connections.closeAll()
+
+	if got, err := GetPackageDiffs(transport, resource.Packages, fromState); err != nil || len(got) != 0 {
+		t.Errorf("GetPackageDiffs() after deploy = %v, %v, want no changes", got, err)
+	}
+	if got := GetFileDiffs(transport, resource.Files, fromState); len(got) != 0 {
+		t.Errorf("GetFileDiffs() after deploy = %v, want no changes", got)
+	}
+
+	// Changing the local file should replace it on the host
+	writeFile(t, "index.php", "<?php echo 'hello'; ?>\n")
+	want := []FileResourceDiff{{Operation: "REPLACE", FileResource: resource.Files[0]}}
+	if got := GetFileDiffs(transport, resource.Files, fromState); !reflect.DeepEqual(got, want) {
+		t.Errorf("GetFileDiffs() after local change = %v, want %v", got, want)
+	}
+}
+
+func TestDeployGroupUpdatesStateByHost(t *testing.T) {
+	server := newTestSSHServer(t)
+	// A second address for the same server, so the group has two hosts
+	listener, err := net.Listen("tcp", net.JoinHostPort("127.0.0.2", fmt.Sprint(server.Port)))
+	if err != nil {
+		t.Skipf("127.0.0.2 is not available: %s", err)
+	}
+	forward(t, listener, net.JoinHostPort(server.Host, fmt.Sprint(server.Port)), 0)
+	htmlDir := filepath.Join(server.Root, "var", "www", "html")
+	if err := os.MkdirAll(htmlDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	chdir(t, t.TempDir())
+	writeFile(t, "index.php", "<?php phpinfo(); ?>\n")
+	config := func(hosts string, mode string) string {
+		return fmt.Sprintf(`groups:
+  web:
+    hosts: [%s]
+    port: %d
+    password: %s
+    retries: 0
+    hostKey:
+      knownHosts: %s
+      trustOnFirstUse: true
+    files:
+      - name: index.php
+        path: %s
+        mode: "%s"
+`, hosts, server.Port, testServerPassword, server.KnownHosts, htmlDir, mode)
+	}
+
+	// stateModes returns the mode of index.php recorded for each entry in
+	// state, failing the test if an entry holds more than one resource
+	stateModes := func(t *testing.T) map[string]string {
+		t.Helper()
+		modes := map[string]string{}
+		for _, entry := range ReadFromState(stateFileName) {
+			if len(entry) != 1 {
+				t.Errorf("state entry %v holds %d resources, want 1", entry, len(entry))
+			}
+			for name, resource := range entry {
+				modes[name] = resource.Files[0].Mode
+			}
+		}
+		return modes
+	}
+
+	writeFile(t, watchedFileName, config("127.0.0.1, 127.0.0.2", "0600"))
+	if err := Deploy(Options{}); err != nil {
+		t.Fatalf("Deploy() error = %s", err)
+	}
+	want := map[string]string{"web/127.0.0.1": "0600", "web/127.0.0.2": "0600"}
+	if got := stateModes(t); !reflect.DeepEqual(got, want) {
+		t.Errorf("state after first deploy = %v, want %v", got, want)
+	}
+
+	// Nothing listens on the changed host, so only the host that was
+	// updated is recorded
+	writeFile(t, watchedFileName, config("127.0.0.1, 127.0.0.3", "0644"))
+	if err := Deploy(Options{}); err != nil {
+		t.Fatalf("Deploy() error = %s", err)
+	}
+	want = map[string]string{"web/127.0.0.1": "0644", "web/127.0.0.2": "0600"}
+	if got := stateModes(t); !reflect.DeepEqual(got, want) {
+		t.Errorf("state after second deploy = %v, want %v", got, want)
+	}
+}
+
+func TestDeployKeepsStateOfUnreachableHost(t *testing.T) {
+	server := newTestSSHServer(t)
+	// A port nothing listens on once the listener is closed
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closedPort := listener.Addr().(*net.TCPAddr).Port
+	listener.Close()
+
+	chdir(t, t.TempDir())
+	config := func(port int, packages string) string {
+		return fmt.Sprintf(`web:
+  host: %s
+  port: %d
+  password: %s
+  retries: 0
+  hostKey:
+    knownHosts: %s
+  packages: [%s]
+`, server.Host, port, testServerPassword, server.KnownHosts, packages)
+	}
+
+	writeFile(t, watchedFileName, config(server.Port, "{package: apache2}"))
+	if err := Deploy(Options{}); err != nil {
+		t.Fatalf("Deploy() error = %s", err)
+	}
+	want := ReadOneFromState(stateFileName, "web")["web"]
+
+	// Only unversioned packages are declared, so nothing but the failed
+	// package query shows that the host was never reached
+	writeFile(t, watchedFileName, config(closedPort, "{package: apache2}, {package: curl}"))
+	if err := Deploy(Options{}); err != nil {
+		t.Fatalf("Deploy() error = %s", err)
+	}
+	if got := ReadOneFromState(stateFileName, "web")["web"]; !reflect.DeepEqual(got, want) {
+		t.Errorf("state after deploying to an unreachable host = %+v, want %+v", got, want)
+	}
+}
@@ -0,0 +1,106 @@
+package configmanage
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Environment names are used in file names, so are kept to characters
+// that are safe in them
+var environmentPattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// Keys identifying an item in a list, so that an item in an overlay can
+// be merged with the same item in the base configuration
+var mergeKeys = []string{"dest", "name", "path", "package", "module"}
+
+// validateEnvironment checks that an environment name can be used in
+// file names
+func validateEnvironment(env string) error {
+	if env != "" && !environmentPattern.MatchString(env) {
+		return fmt.Errorf("invalid environment %q, only letters, numbers, - and _ are allowed", env)
+	}
+	return nil
+}
+
+// environmentFile returns the name of the file for env alongside path,
+// so glue.yaml becomes glue.prod.yaml
+func environmentFile(path string, env string) string {
+	ext := filepath.Ext(path)
+	return strings.TrimSuffix(path, ext) + "." + env + ext
+}
+
+// mergeNode merges an overlay into a base node and returns the result.
+// Maps are merged key by key, lists of items with a merge key are merged
+// item by item, and anything else in the overlay replaces the base
+func mergeNode(base *yaml.Node, overlay *yaml.Node) *yaml.Node {
+	switch {
+	case base.Kind == yaml.MappingNode && overlay.Kind == yaml.MappingNode:
+		for i := 0; i+1 < len(overlay.Content); i += 2 {
+			key, value := overlay.Content[i], overlay.Content[i+1]
+			merged := false
+			for j := 0; j+1 < len(base.Content); j += 2 {
+				if base.Content[j].Value == key.Value {
+					base.Content[j+1] = mergeNode(base.Content[j+1], value)
+					merged = true
+					break
+				}
+			}
+			if !merged {
+				base.Content = append(base.Content, key, value)
+			}
+		}
+		return base
+	case base.Kind == yaml.SequenceNode && overlay.Kind == yaml.SequenceNode:
+		if !hasMergeKeys(base) || !hasMergeKeys(overlay) {
+			return overlay
+		}
+		for _, item := range overlay.Content {
+			merged := false
+			for j, existing := range base.Content {
+				if mergeKey(existing) == mergeKey(item) {
+					base.Content[j] = mergeNode(existing, item)
+					merged = true
+					break
+				}
+			}
+			if !merged {
+				base.Content = append(base.Content, item)
+			}
+		}
+		return base
+	default:
+		return overlay
+	}
+}
+
+// hasMergeKeys reports whether every item in a list can be identified
+// by its merge keys
+func hasMergeKeys(list *yaml.Node) bool {
+	for _, item := range list.Content {
+		if mergeKey(item) == "" {
+			return false
+		}
+	}
+	return true
+}
+
+// mergeKey returns the values of an item's merge keys, or an empty string
+// if it has none
+func mergeKey(item *yaml.Node) string {
+	if item.Kind != yaml.MappingNode {
+		return ""
+	}
+	var parts []string
+	for _, k := range mergeKeys {
+		for i := 0; i+1 < len(item.Content); i += 2 {
+			if item.Content[i].Value == k && item.Content[i+1].Kind == yaml.ScalarNode {
+				parts = append(parts, k+"="+item.Content[i+1].Value)
+			}
+		}
+	}
+	return strings.Join(parts, " ")
+}
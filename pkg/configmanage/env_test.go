@@ -0,0 +1,102 @@
+package configmanage
+
+import (
+	"reflect"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+func TestMergeNode(t *testing.T) {
+	tests := []struct {
+		name    string
+		base    string
+		overlay string
+		want    string
+	}{
+		{
+			name:    "Maps should be merged key by key",
+			base:    "web:\n  host: 10.0.0.1\n  user: deploy\n",
+			overlay: "web:\n  host: 10.1.0.1\n  port: 2222\n",
+			want:    "web:\n  host: 10.1.0.1\n  user: deploy\n  port: 2222\n",
+		},
+		{
+			name:    "Resources only in the overlay should be added",
+			base:    "web:\n  host: 10.0.0.1\n",
+			overlay: "db:\n  host: 10.1.0.2\n",
+			want:    "web:\n  host: 10.0.0.1\ndb:\n  host: 10.1.0.2\n",
+		},
+		{
+			name:    "Packages should be merged by package",
+			base:    "packages:\n  - package: nginx\n    version: 1.18.0\n  - package: curl\n",
+			overlay: "packages:\n  - package: nginx\n    version: 1.22.1\n  - package: htop\n",
+			want:    "packages:\n  - package: nginx\n    version: 1.22.1\n  - package: curl\n  - package: htop\n",
+		},
+		{
+			name:    "Files should be merged by destination",
+			base:    "files:\n  - source: nginx.conf\n    dest: /etc/nginx/nginx.conf\n    mode: \"0644\"\n",
+			overlay: "files:\n  - source: nginx.prod.conf\n    dest: /etc/nginx/nginx.conf\n",
+			want:    "files:\n  - source: nginx.prod.conf\n    dest: /etc/nginx/nginx.conf\n    mode: \"0644\"\n",
+		},
+		{
+			name:    "Files with the same name in different paths should be kept apart",
+			base:    "files:\n  - name: index.php\n    path: /var/www/a\n",
+			overlay: "files:\n  - name: index.php\n    path: /var/www/b\n",
+			want:    "files:\n  - name: index.php\n    path: /var/www/a\n  - name: index.php\n    path: /var/www/b\n",
+		},
+		{
+			name:    "Lists without merge keys should be replaced",
+			base:    "command: ['service', 'nginx', 'reload']\n",
+			overlay: "command: ['service', 'nginx', 'restart']\n",
+			want:    "command: ['service', 'nginx', 'restart']\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var base, overlay, want yaml.Node
+			for _, doc := range []struct {
+				node *yaml.Node
+				text string
+			}{{&base, tt.base}, {&overlay, tt.overlay}, {&want, tt.want}} {
+				if err := yaml.Unmarshal([]byte(doc.text), doc.node); err != nil {
+					t.Fatal(err)
+				}
+			}
+			var got, wantValue interface{}
+			if err := mergeNode(base.Content[0], overlay.Content[0]).Decode(&got); err != nil {
+				t.Fatal(err)
+			}
+			if err := want.Content[0].Decode(&wantValue); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, wantValue) {
+				t.Errorf("mergeNode() = %v, want %v", got, wantValue)
+			}
+			// Key order is kept so that output follows the base file
+			gotText, _ := yaml.Marshal(base.Content[0])
+			wantText, _ := yaml.Marshal(want.Content[0])
+			if string(gotText) != string(wantText) {
+				t.Errorf("mergeNode() =\n%s\nwant\n%s", gotText, wantText)
+			}
+		})
+	}
+}
+
+func TestEnvironmentFile(t *testing.T) {
+	tests := []struct {
+		path string
+		want string
+	}{
+		{path: "glue.yaml", want: "glue.prod.yaml"},
+		{path: "web/glue.yaml", want: "web/glue.prod.yaml"},
+		{path: "staging.yml", want: "staging.prod.yml"},
+		{path: "glueprint-state.json", want: "glueprint-state.prod.json"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			if got := environmentFile(tt.path, "prod"); got != tt.want {
+				t.Errorf("environmentFile() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,98 @@
+package configmanage
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
+)
+
+// configError is a problem at a position in a configuration file
+type configError struct {
+	File    string
+	Line    int
+	Column  int
+	Message string
+}
+
+// newConfigError returns a problem at the position of node
+func newConfigError(node *yaml.Node, format string, args ...interface{}) configError {
+	return configError{Line: node.Line, Column: node.Column, Message: fmt.Sprintf(format, args...)}
+}
+
+func (e configError) Error() string {
+	switch {
+	case e.File == "":
+		return fmt.Sprintf("line %d column %d: %s", e.Line, e.Column, e.Message)
+	case e.Column == 0:
+		return fmt.Sprintf("%s:%d: %s", e.File, e.Line, e.Message)
+	default:
+		return fmt.Sprintf("%s:%d:%d: %s", e.File, e.Line, e.Column, e.Message)
+	}
+}
+
+// errorList collects problems so that they can be reported together
+type errorList []error
+
+func (l errorList) Error() string {
+	messages := make([]string, len(l))
+	for i, err := range l {
+		messages[i] = err.Error()
+	}
+	return strings.Join(messages, "\n")
+}
+
+// err returns the list as an error, or nil if it is empty
+func (l errorList) err() error {
+	if len(l) == 0 {
+		return nil
+	}
+	return l
+}
+
+// withFile records the file that problems found in a configuration
+// file's nodes were found in
+func withFile(err error, file string) error {
+	switch e := err.(type) {
+	case configError:
+		if e.File == "" {
+			e.File = file
+		}
+		return e
+	case errorList:
+		out := make(errorList, len(e))
+		for i, err := range e {
+			out[i] = withFile(err, file)
+		}
+		return out
+	default:
+		return err
+	}
+}
+
+// Matches the position yaml gives for syntax errors
+var yamlErrorPattern = regexp.MustCompile(`^yaml: line (\d+): (.*)$`)
+
+// syntaxError returns a yaml syntax error in file with its position
+func syntaxError(err error, file string) error {
+	parts := yamlErrorPattern.FindStringSubmatch(err.Error())
+	if parts == nil {
+		return fmt.Errorf("%s: %s", file, err)
+	}
+	line, _ := strconv.Atoi(parts[1])
+	return configError{File: file, Line: line, Message: parts[2]}
+}
+
+// logErrors logs each problem in err on a line of its own
+func logErrors(err error) {
+	if list, ok := err.(errorList); ok {
+		for _, err := range list {
+			log.Error(err)
+		}
+		return
+	}
+	log.Error(err)
+}
@@ -2,132 +2,251 @@ package configmanage
 
 import (
 	"bytes"
+	"crypto/sha1"
 	"fmt"
-	"os/exec"
-	"strconv"
+	"os"
+	"path/filepath"
 	"strings"
+	"time"
 
+	"github.com/echoboomer/glueprint/pkg/common"
 	"github.com/fatih/color"
 	"github.com/kyokomi/emoji/v2"
-	"github.com/r3labs/diff/v3"
 	log "github.com/sirupsen/logrus"
-	"golang.org/x/crypto/ssh"
 )
 
-var sshPort string = "22"
+// Connection defaults used when a managed resource does not specify a
+// port or login user
+var defaultSSHPort int = 22
+var defaultUsername string = "root"
+
+// Defaults for connection handling when a managed resource does not
+// override them - commands are not limited unless a timeout is set
+var defaultConnectTimeout time.Duration = 10 * time.Second
+var defaultKeepaliveInterval time.Duration = 15 * time.Second
+var defaultRetries int = 3
 
 type Credentials struct {
-	Hostname string
-	Username string
-	Password string
+	Hostname   string
+	Port       int
+	Username   string
+	Password   string
+	AuthMethod string
+	KeyFile    string
+	Passphrase string
+	Transport  string
+	// CertificateFile is an ssh certificate issued for the key in KeyFile
+	CertificateFile string
+	// Host key verification
+	KnownHostsFile  string
+	TrustOnFirstUse bool
+	HostCAFile      string
+	// Privilege escalation
+	Become         bool
+	BecomePassword string
+	// Connection handling
+	ConnectTimeout    time.Duration
+	CommandTimeout    time.Duration
+	KeepaliveInterval time.Duration
+	Retries           int
+	// Stream prints command output line by line as it is produced
+	Stream bool
+	// Bastion is the jump host this host is reached through, if any
+	Bastion *Credentials
 }
 
-// RunOnRemoteHost allows execution of a command on a host via an ssh
-// shell - useful for managing resources on remote hosts
-func RunOnRemoteHost(credentials Credentials, command string) (string, error) {
-	config := &ssh.ClientConfig{
-		User: credentials.Username,
-		Auth: []ssh.AuthMethod{
-			ssh.Password(credentials.Password),
-		},
-		// This is never acceptable in production, but is suitable for a demo
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+// newCredentials returns the credentials used to connect to a managed
+// resource, resolving any secrets it references
+func newCredentials(resource ManagedResource) (Credentials, error) {
+	password, err := resource.Password.Resolve(resource.secrets)
+	if err != nil {
+		return Credentials{}, fmt.Errorf("error resolving password: %s", err)
 	}
-
-	hostAddress := strings.Join([]string{credentials.Hostname, sshPort}, ":")
-	client, err := ssh.Dial("tcp", hostAddress, config)
+	passphrase, err := resource.Auth.Passphrase.Resolve(resource.secrets)
 	if err != nil {
-		log.Errorf("Error executing command on host: %s", err)
-		return "", err
+		return Credentials{}, fmt.Errorf("error resolving key passphrase: %s", err)
 	}
-	defer client.Close()
-
-	session, err := client.NewSession()
+	becomePassword, err := resource.BecomePassword.Resolve(resource.secrets)
 	if err != nil {
-		log.Errorf("Error executing command on host: %s", err)
-		return "", err
+		return Credentials{}, fmt.Errorf("error resolving become password: %s", err)
+	}
+
+	port := resource.Port
+	if port == 0 {
+		port = defaultSSHPort
 	}
-	defer session.Close()
+	username := resource.User
+	if username == "" {
+		username = defaultUsername
+	}
+	connectTimeout := resource.Timeouts.Connect
+	if connectTimeout == 0 {
+		connectTimeout = defaultConnectTimeout
+	}
+	keepaliveInterval := resource.Timeouts.Keepalive
+	if keepaliveInterval == 0 {
+		keepaliveInterval = defaultKeepaliveInterval
+	}
+	retries := defaultRetries
+	if resource.Retries != nil {
+		retries = *resource.Retries
+	}
+	credentials := Credentials{
+		Hostname:   resource.Host,
+		Transport:  resource.Transport,
+		Port:       port,
+		Username:   username,
+		Password:   password,
+		AuthMethod: resource.Auth.Method,
+		KeyFile:    resource.localPath(resource.Auth.Key),
+		Passphrase: passphrase,
+
+		CertificateFile: resource.localPath(resource.Auth.Certificate),
+
+		KnownHostsFile:  resource.localPath(resource.HostKey.KnownHosts),
+		TrustOnFirstUse: resource.HostKey.TrustOnFirstUse,
+		HostCAFile:      resource.localPath(resource.HostKey.CertAuthority),
 
-	var outb, errb bytes.Buffer
-	session.Stdout = &outb
-	session.Stderr = &errb
-	fmt.Println(errb.String())
-	if err := session.Run(command); err != nil {
-		log.Errorf("Error executing command on host: %s", err)
-		return "", err
+		Become:         resource.Become,
+		BecomePassword: becomePassword,
+
+		ConnectTimeout:    connectTimeout,
+		CommandTimeout:    resource.Timeouts.Command,
+		KeepaliveInterval: keepaliveInterval,
+		Retries:           retries,
+	}
+	if resource.Bastion != nil {
+		// Bastions are verified against the same known hosts, and use
+		// the same connection handling, as the resource they lead to
+		bastion, err := newCredentials(ManagedResource{
+			Host:     resource.Bastion.Host,
+			Port:     resource.Bastion.Port,
+			User:     resource.Bastion.User,
+			Password: resource.Bastion.Password,
+			Auth:     resource.Bastion.Auth,
+			HostKey:  resource.HostKey,
+			Bastion:  resource.Bastion.Bastion,
+			Timeouts: resource.Timeouts,
+			Retries:  resource.Retries,
+			secrets:  resource.secrets,
+			dir:      resource.dir,
+		})
+		if err != nil {
+			return Credentials{}, fmt.Errorf("bastion %s: %s", resource.Bastion.Host, err)
+		}
+		credentials.Bastion = &bastion
 	}
+	return credentials, nil
+}
 
-	return outb.String(), nil
+// localPath returns a path on this machine given in a resource's
+// configuration, relative to the configuration file declaring it
+func (r ManagedResource) localPath(path string) string {
+	if path == "" {
+		return ""
+	}
+	path = common.ExpandHomeDir(path)
+	if filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(r.dir, path)
 }
 
 // GetFileDiffs processes a slice of FileSpecification and determines changes for
-// resources that already have state entries
-func GetFileDiffs(credentials Credentials, files []FileSpecification, fromState ManagedResource) []FileResourceDiff {
+// resources that already have state entries. Files are matched with their
+// state entries by destination, so reordering them or changing where
+// their content is sourced from doesn't move them on the host
+func GetFileDiffs(transport Transport, files []FileSpecification, fromState ManagedResource) []FileResourceDiff {
 	_, err := emoji.Printf(":file_folder: %s\n", "Files")
 	if err != nil {
 		log.Fatal(err)
 	}
 	fmt.Println("-----------------------------------")
 	var diffs []FileResourceDiff
-	changelog, err := diff.Diff(fromState.Files, files, diff.DisableStructValues())
-	if err != nil {
-		log.Errorf("Error comparing filesets: %s", err)
-	}
-	if len(changelog) != 0 {
-		for _, ch := range changelog {
-			switch ch.Type {
-			case "delete":
-				idx, _ := strconv.Atoi(ch.Path[0])
-				fileToDelete := fromState.Files[idx]
-				color.Yellow("File %s will be deleted", strings.Join([]string{fileToDelete.Path, fileToDelete.Name}, "/"))
-				diffs = append(diffs, FileResourceDiff{Operation: strings.ToUpper(ch.Type), Target: "", FileResource: fileToDelete})
-			case "update":
-				idx, _ := strconv.Atoi(ch.Path[0])
-				field := ch.Path[1]
-				fileToUpdate := fromState.Files[idx]
-				switch field {
-				case "Mode":
-					color.Yellow("File %s will be updated in place:", strings.Join([]string{fileToUpdate.Path, fileToUpdate.Name}, "/"))
-					color.Yellow("%s: %s -> %s", field, ch.From, ch.To)
-					diffs = append(diffs, FileResourceDiff{Operation: strings.ToUpper(ch.Type), Target: field, UpdateValue: ch.To, FileResource: fileToUpdate})
-				case "Name", "Path":
-					color.Yellow("File %s will be updated as its configuration has changed:", strings.Join([]string{fileToUpdate.Path, fileToUpdate.Name}, "/"))
-					color.Yellow("%s: %s -> %s", field, ch.From, ch.To)
-					diffs = append(diffs, FileResourceDiff{Operation: "REPLACE", FileResource: fileToUpdate})
+
+	inState := map[string]FileSpecification{}
+	for _, file := range fromState.Files {
+		inState[file.destination()] = file
+	}
+
+	declared := map[string]bool{}
+	for _, file := range files {
+		dest := file.destination()
+		if declared[dest] {
+			log.Errorf("File %s is declared more than once, ignoring duplicate", dest)
+			continue
+		}
+		declared[dest] = true
+
+		stateFile, ok := inState[dest]
+		if !ok {
+			color.Yellow("File %s will be created", dest)
+			// Rendered templates are shown as they will be written
+			if file.Template {
+				content, err := localFileContent(file)
+				if err != nil {
+					log.Errorf("Error rendering file: %s", err)
+				} else {
+					printLineDiff("", string(content))
 				}
-			case "create":
-				conv := ch.To.(FileSpecification)
-				color.Yellow("File %s will be created", strings.Join([]string{conv.Path, conv.Name}, "/"))
-				diffs = append(diffs, FileResourceDiff{Operation: strings.ToUpper(ch.Type), FileResource: ch.To.(FileSpecification)})
 			}
+			diffs = append(diffs, FileResourceDiff{Operation: "CREATE", FileResource: file})
+			continue
 		}
-	} else {
-		// If there were no diffs on file config, check for diff in file content
-		for _, file := range files {
-			localFileHash, err := exec.Command("sha1sum", file.Name).Output()
-			if err != nil {
-				log.Errorf("Error getting file hash: %s", err)
-			}
-			remoteFileHash, err := RunOnRemoteHost(credentials, fmt.Sprintf("sha1sum %s", strings.Join([]string{file.Path, file.Name}, "/")))
-			if err != nil {
-				log.Errorf("Error executing command: %s", err)
-			}
-			// Compare hash values for files to determine if there is a diff
-			if strings.Split(string(localFileHash), " ")[0] == strings.Split(remoteFileHash, " ")[0] {
-				color.Green("File %s unchanged", strings.Join([]string{file.Path, file.Name}, "/"))
-			} else {
-				color.Yellow("File %s will be updated in place as its contents has changed", strings.Join([]string{file.Path, file.Name}, "/"))
-				diffs = append(diffs, FileResourceDiff{Operation: "REPLACE", FileResource: file})
+
+		content, err := localFileContent(file)
+		if err != nil {
+			log.Errorf("Error getting file hash: %s", err)
+			continue
+		}
+		localFileHash := fmt.Sprintf("%x", sha1.Sum(content))
+		remoteFileHash, err := transport.Run(fmt.Sprintf("sha1sum %s", shellQuote(dest)), nil)
+		if err != nil {
+			log.Errorf("Error executing command: %s", err)
+		}
+		// Compare hash values for files to determine if there is a diff
+		if localFileHash == strings.Split(remoteFileHash.Stdout, " ")[0] {
+			color.Green("File %s unchanged", dest)
+		} else {
+			color.Yellow("File %s will be updated in place as its contents has changed", dest)
+			// Rendered templates are shown as they will change
+			if file.Template {
+				remoteContent, err := transport.GetFile(dest)
+				if err != nil {
+					log.Errorf("Error reading file from host: %s", err)
+				} else {
+					printLineDiff(string(remoteContent), string(content))
+				}
 			}
+			diffs = append(diffs, FileResourceDiff{Operation: "REPLACE", FileResource: file})
+		}
+
+		// Modes are applied after any replacement so that they stick
+		if file.Mode != stateFile.Mode {
+			color.Yellow("File %s will be updated in place:", dest)
+			color.Yellow("Mode: %s -> %s", stateFile.Mode, file.Mode)
+			diffs = append(diffs, FileResourceDiff{Operation: "UPDATE", Target: "Mode", UpdateValue: file.Mode, FileResource: file})
+		}
+		if file.Owner != stateFile.Owner && file.Owner != "" {
+			color.Yellow("File %s will be updated in place:", dest)
+			color.Yellow("Owner: %s -> %s", stateFile.Owner, file.Owner)
+			diffs = append(diffs, FileResourceDiff{Operation: "UPDATE", Target: "Owner", UpdateValue: file.Owner, FileResource: file})
+		}
+	}
+
+	for _, file := range fromState.Files {
+		if !declared[file.destination()] {
+			color.Yellow("File %s will be deleted", file.destination())
+			diffs = append(diffs, FileResourceDiff{Operation: "DELETE", FileResource: file})
 		}
 	}
 	return diffs
 }
 
 // GetPackageDiffs iterates through requested packages on a managed
-// resource and shows and returns any diffs
-func GetPackageDiffs(credentials Credentials, pkgs []PackageSpecification, fromState ManagedResource) []PackageResourceDiff {
+// resource and shows and returns any diffs, or an error if the state of
+// a package on the host can't be determined
+func GetPackageDiffs(transport Transport, pkgs []PackageSpecification, fromState ManagedResource) ([]PackageResourceDiff, error) {
 	_, err := emoji.Printf(":wrench: %s\n", "Packages")
 	if err != nil {
 		log.Fatal(err)
@@ -137,11 +256,14 @@ func GetPackageDiffs(credentials Credentials, pkgs []PackageSpecification, fromS
 	for _, p := range pkgs {
 		log.Infof("Determining state of package %s on host...", p.Package)
 		command := fmt.Sprintf("dpkg-query --show %s", p.Package)
-		result, err := RunOnRemoteHost(credentials, command)
-		if err != nil {
-			log.Errorf("Error executing command: %s", err)
+		result, err := transport.Run(command, nil)
+		// dpkg-query exits with a non-zero status for packages it does
+		// not know about
+		notInstalled := strings.Contains(result.Stdout+result.Stderr, fmt.Sprintf("dpkg-query: no packages found matching %s", p.Package))
+		if err != nil && !notInstalled {
+			return nil, fmt.Errorf("error determining state of package %s: %s", p.Package, err)
 		}
-		if strings.Contains(result, fmt.Sprintf("dpkg-query: no packages found matching %s", p.Package)) {
+		if notInstalled {
 			if p.Version != "" {
 				color.Red("Package %s is not installed and will be installed using version %s", p.Package, p.Version)
 				diffs = append(diffs, PackageResourceDiff{
@@ -157,31 +279,32 @@ func GetPackageDiffs(credentials Credentials, pkgs []PackageSpecification, fromS
 			}
 		} else {
 			command := fmt.Sprintf("dpkg-query --showformat='${Version}' --show %s", p.Package)
-			result, err := RunOnRemoteHost(credentials, command)
+			result, err := transport.Run(command, nil)
 			if err != nil {
-				log.Errorf("Error executing command: %s", err)
+				return nil, fmt.Errorf("error determining version of package %s: %s", p.Package, err)
 			}
-			if p.Version != "" && result == p.Version {
+			version := result.Stdout
+			if p.Version != "" && version == p.Version {
 				color.Green("Package %s is installed and matches specified version %s", p.Package, p.Version)
-				return []PackageResourceDiff{}
-			} else if p.Version != "" && result != p.Version {
-				color.Red("Package %s is installed at version %s and will be upgraded to %s", p.Package, result, p.Version)
+				return []PackageResourceDiff{}, nil
+			} else if p.Version != "" && version != p.Version {
+				color.Red("Package %s is installed at version %s and will be upgraded to %s", p.Package, version, p.Version)
 				diffs = append(diffs, PackageResourceDiff{
 					Operation:       "INSTALL",
 					PackageResource: p,
 				})
 			} else if p.Version == "" {
-				color.Green("Package %s is installed at version %s", p.Package, result)
+				color.Green("Package %s is installed at version %s", p.Package, version)
 			}
 		}
 	}
-	return diffs
+	return diffs, nil
 }
 
 // Package Management
 
 // InstallPackage installs a package on a managed resource
-func InstallPackage(credentials Credentials, pkg PackageSpecification) {
+func InstallPackage(transport Transport, pkg PackageSpecification) error {
 	var command string
 	if pkg.Version == "" || pkg.Version == "latest" {
 		color.Green("Installing package %s with latest version...", pkg.Package)
@@ -190,54 +313,149 @@ func InstallPackage(credentials Credentials, pkg PackageSpecification) {
 		color.Green("Installing package %s with version %s...", pkg.Package, pkg.Version)
 		command = fmt.Sprintf("apt update && apt install -y %s=%s", pkg.Package, pkg.Version)
 	}
-	result, err := RunOnRemoteHost(credentials, command)
+	result, err := transport.Run(command, nil)
 	if err != nil {
 		log.Errorf("Error executing command: %s", err)
 	}
-	fmt.Println(result)
+	printOutput(result)
+	return err
 }
 
 // RemovePackage removes a package from a managed resource
-func RemovePackage(credentials Credentials, pkg PackageSpecification) {
+func RemovePackage(transport Transport, pkg PackageSpecification) error {
 	command := fmt.Sprintf("apt remove -y %s", pkg.Package)
-	result, err := RunOnRemoteHost(credentials, command)
+	result, err := transport.Run(command, nil)
 	if err != nil {
 		log.Errorf("Error executing command: %s", err)
 	}
-	fmt.Println(result)
+	printOutput(result)
+	return err
 }
 
 // File management
 
+// source returns the local file a managed file's content is read from,
+// relative to the configuration file declaring it
+func (f FileSpecification) source() string {
+	source := f.Source
+	if source == "" {
+		source = f.Name
+	}
+	source = common.ExpandHomeDir(source)
+	if filepath.IsAbs(source) {
+		return source
+	}
+	return filepath.Join(f.Dir, source)
+}
+
+// destination returns the full path of a managed file on the host - a
+// dest ending in a slash is a directory the source is placed in
+func (f FileSpecification) destination() string {
+	if f.Dest == "" {
+		return strings.Join([]string{f.Path, f.Name}, "/")
+	}
+	if strings.HasSuffix(f.Dest, "/") {
+		return f.Dest + filepath.Base(f.source())
+	}
+	return f.Dest
+}
+
 // DeleteFile removes a file from a managed resource
-func DeleteFile(credentials Credentials, file FileSpecification) {
-	fileName := strings.Join([]string{file.Path, file.Name}, "/")
-	command := fmt.Sprintf("rm %s && echo true || echo false", fileName)
-	result, err := RunOnRemoteHost(credentials, command)
+func DeleteFile(transport Transport, file FileSpecification) error {
+	fileName := file.destination()
+	command := fmt.Sprintf("rm %s", shellQuote(fileName))
+	result, err := transport.Run(command, nil)
 	if err != nil {
 		log.Errorf("Error executing command: %s", err)
-	}
-	fmt.Println(result)
-	if strings.Contains(result, "true") {
-		color.Green("File %s removed successfully", fileName)
-	} else {
+		printOutput(result)
 		color.Red("Failed to delete file %s", fileName)
+	} else {
+		color.Green("File %s removed successfully", fileName)
+	}
+	return err
+}
+
+// UploadFile places a local file onto a managed resource
+func UploadFile(transport Transport, file FileSpecification) error {
+	fileName := file.destination()
+
+	content, err := localFileContent(file)
+	if err != nil {
+		return err
+	}
+
+	copied, err := transport.PutFile(fileName, bytes.NewReader(content))
+	if err != nil {
+		return err
+	}
+	color.Green("%d bytes copied to %s on host", copied, fileName)
+
+	// Permissions and ownership are applied once the file is in place
+	if file.Mode != "" {
+		result, err := transport.Run(fmt.Sprintf("chmod %s %s", shellQuote(file.Mode), shellQuote(fileName)), nil)
+		if err != nil {
+			printOutput(result)
+			return fmt.Errorf("error setting file mode: %s", err)
+		}
+	}
+	if file.Owner != "" {
+		result, err := transport.Run(fmt.Sprintf("chown %s %s", shellQuote(file.Owner), shellQuote(fileName)), nil)
+		if err != nil {
+			printOutput(result)
+			return fmt.Errorf("error setting file owner: %s", err)
+		}
 	}
+	return nil
+}
+
+// localFileContent returns the content a managed file should have,
+// given inline or read from the local source file or the secrets file,
+// and rendered if it is a template
+func localFileContent(file FileSpecification) ([]byte, error) {
+	if file.rendered != nil {
+		return file.rendered, nil
+	}
+	if file.Content != nil {
+		return []byte(*file.Content), nil
+	}
+	if file.Secret != "" {
+		content, err := lookupSecret(file.secrets, file.Secret)
+		if err != nil {
+			return nil, err
+		}
+		return []byte(content), nil
+	}
+	return os.ReadFile(file.source())
 }
 
 // UpdateFileMode updates a file's permissions
-func UpdateFileMode(credentials Credentials, file FileSpecification) {
+func UpdateFileMode(transport Transport, file FileSpecification) error {
 	//target will either be content or mode
-	fileName := strings.Join([]string{file.Path, file.Name}, "/")
+	fileName := file.destination()
 	// Set file mode
-	command := fmt.Sprintf("chmod -v %s %s && echo true || echo false", file.Mode, fileName)
-	result, err := RunOnRemoteHost(credentials, command)
+	command := fmt.Sprintf("chmod %s %s", shellQuote(file.Mode), shellQuote(fileName))
+	result, err := transport.Run(command, nil)
 	if err != nil {
 		log.Errorf("Error setting file mode: %s", err)
-	}
-	if strings.Contains(result, "true") {
-		color.Green("File %s updated successfully", fileName)
+		printOutput(result)
+		color.Red("Failed to update file %s", fileName)
 	} else {
+		color.Green("File %s updated successfully", fileName)
+	}
+	return err
+}
+
+// UpdateFileOwner updates a file's owner
+func UpdateFileOwner(transport Transport, file FileSpecification) error {
+	fileName := file.destination()
+	command := fmt.Sprintf("chown %s %s", shellQuote(file.Owner), shellQuote(fileName))
+	result, err := transport.Run(command, nil)
+	if err != nil {
+		log.Errorf("Error setting file owner: %s", err)
+		printOutput(result)
 		color.Red("Failed to update file %s", fileName)
+	} else {
+		color.Green("File %s updated successfully", fileName)
 	}
+	return err
 }
@@ -1,8 +1,12 @@
 package configmanage
 
 import (
+	"bufio"
+	"fmt"
 	"io/fs"
 	"os"
+	"path/filepath"
+	"strings"
 
 	"github.com/kyokomi/emoji/v2"
 	log "github.com/sirupsen/logrus"
@@ -13,73 +17,393 @@ import (
 // not there are resources to manage
 var watchedFileName string = "glue.yaml"
 
-// listDirectoryContents returns objects in the directory in which the
-// utility is called from
-func listDirectoryContents() ([]fs.DirEntry, error) {
-	// Context is always current directory
-	path, err := os.Getwd()
-	if err != nil {
-		return nil, err
-	}
+// The top level key in a configuration file holding variables for every
+// resource in it, which can't be used as a resource name
+var varsKey string = "vars"
+
+// The file listing patterns for paths that are skipped when searching
+// for configuration files
+var ignoreFileName string = ".glueprintignore"
 
-	// Get all files in current directory
-	files, err := os.ReadDir(path)
+// Paths that are always skipped when searching for configuration files
+var defaultIgnorePatterns = []string{".git"}
+
+// parseConfigurationFile returns the contents of the configuration file
+// named in opts, or of those discovered in the working directory
+func parseConfigurationFile(opts Options) ([]map[string]ManagedResource, error) {
+	var parsedFileContents = []map[string]ManagedResource{}
+
+	err := validateEnvironment(opts.Env)
 	if err != nil {
+		log.Errorf("Error selecting environment: %s", err)
 		return nil, err
 	}
-	return files, nil
-}
 
-// parseConfigurationFile returns the contents of discovered configuration
-// files
-func parseConfigurationFile() ([]map[string]ManagedResource, error) {
-	var parsedFileContents = []map[string]ManagedResource{}
+	results := []string{opts.ConfigFile}
+	if opts.ConfigFile == "" {
+		results, err = traverseFiles(opts.workDir())
+		if err != nil {
+			log.Errorf("Error listing directory contents: %s", err)
+			return nil, err
+		}
+		if len(results) < 1 {
+			log.Warnf("No files matching %s were found in %s.\n"+
+				"To use glueprint, create a file called %s and specify a configuration.\n"+
+				"More details are available in the docs.", watchedFileName, opts.workDir(), watchedFileName)
+		}
+	}
 
-	currentDirectoryFiles, err := listDirectoryContents()
+	overrides, err := variableOverrides(opts)
 	if err != nil {
-		log.Errorf("Error listing directory contents: %s", err)
+		log.Errorf("Error reading variables: %s", err)
 		return nil, err
 	}
 
-	results := traverseFiles(currentDirectoryFiles)
-	if len(results) < 1 {
-		log.Warnf("No files matching %s were found in current directory.\n"+
-			"To use glueprint, create a file called %s and specify a configuration.\n"+
-			"More details are available in the docs.", watchedFileName, watchedFileName)
-	}
+	// Resources are tracked in state by name, so names must be unique
+	// across configuration files
+	declaredIn := map[string]string{}
+	overlays := 0
 	for _, f := range results {
-		out := make(map[string]ManagedResource)
-		data, err := os.ReadFile(f.Name())
+		dir := filepath.Dir(f)
+		// Secrets kept alongside the configuration file are available
+		// to it, and only to it
+		secrets, err := loadSecretsFile(dir)
+		if err != nil {
+			log.Errorf("Error loading secrets file: %s", err)
+			return nil, err
+		}
+		data, err := os.ReadFile(f)
 		if err != nil {
 			log.Errorf("Error reading configuration file: %s", err)
 			return nil, err
 		}
-		err = yaml.Unmarshal([]byte(string(data)), &out)
+		sources := []configurationSource{{path: f, data: data}}
+		if opts.Env != "" {
+			overlay := environmentFile(f, opts.Env)
+			data, err := readOverlay(overlay)
+			if err != nil {
+				log.Errorf("Error reading overlay for %s: %s", f, err)
+				return nil, err
+			}
+			if data != nil {
+				sources = append(sources, configurationSource{path: overlay, data: data})
+				overlays++
+			}
+		}
+		out, vars, err := decodeConfiguration(sources, overrides)
 		if err != nil {
-			log.Errorf("Error parsing configuration file: %s", err)
+			return nil, err
+		}
+		for k, v := range out {
+			if other, ok := declaredIn[k]; ok {
+				return nil, fmt.Errorf("resource %s is declared in both %s and %s", k, other, f)
+			}
+			declaredIn[k] = f
+			v, err = expandModules(v, dir)
+			if err != nil {
+				log.Errorf("Error parsing configuration file %s: resource %s: %s", f, k, err)
+				return nil, fmt.Errorf("%s: resource %s: %s", f, k, err)
+			}
+			// Variables declared for the whole file can be overridden
+			// by each resource
+			v.Vars = mergeVars(vars, v.Vars)
+			v.secrets = secrets
+			v.dir = dir
+			for i := range v.Files {
+				v.Files[i].secrets = secrets
+				// Files are sourced relative to the configuration file,
+				// or the module, declaring them
+				if v.Files[i].Dir == "" {
+					v.Files[i].Dir = dir
+				}
+				if v.Files[i].Template {
+					err := renderFile(k, v, &v.Files[i])
+					if err != nil {
+						return nil, err
+					}
+				}
+			}
+			out[k] = v
 		}
 		parsedFileContents = append(parsedFileContents, out)
 	}
+	// An environment without a single overlay is most likely a typo
+	if opts.Env != "" && len(results) > 0 && overlays == 0 {
+		err := fmt.Errorf("no %s overlays were found for environment %s", environmentFile(filepath.Base(results[0]), opts.Env), opts.Env)
+		log.Errorf("Error selecting environment: %s", err)
+		return nil, err
+	}
 
 	return parsedFileContents, nil
 }
 
-// traverseFiles loops over objects passed in to determine if a target
-// set of files exists
-func traverseFiles(files []fs.DirEntry) []fs.DirEntry {
-	foundFiles := []fs.DirEntry{}
-	for _, file := range files {
-		if file.IsDir() {
-			// ToDo: handle recursive file lookups
+// configurationSource is the content of a configuration file or one of
+// its overlays
+type configurationSource struct {
+	path string
+	data []byte
+}
+
+// decodeConfiguration reads the resources declared in a configuration
+// file, merged with any environment overlays following it, along with
+// the variables declared for the whole file, after interpolating its
+// variables and any overrides into them. Every problem found is
+// reported with the file and position it was found at
+func decodeConfiguration(sources []configurationSource, overrides map[string]variable) (map[string]ManagedResource, map[string]interface{}, error) {
+	var errs errorList
+	var documents []*yaml.Node
+	var paths []string
+	for _, source := range sources {
+		var root yaml.Node
+		err := yaml.Unmarshal(source.data, &root)
+		if err != nil {
+			errs = append(errs, syntaxError(err, source.path))
+			continue
+		}
+		if len(root.Content) == 0 {
+			continue
+		}
+		if root.Content[0].Kind != yaml.MappingNode {
+			errs = append(errs, withFile(newConfigError(root.Content[0], "configuration must be a map of resources"), source.path))
+			continue
+		}
+		documents = append(documents, root.Content[0])
+		paths = append(paths, source.path)
+	}
+	if len(errs) > 0 {
+		return nil, nil, errs
+	}
+
+	// Variables in overlays override those in the file they are merged
+	// over
+	variables := map[string]variable{}
+	for i, document := range documents {
+		node := mappingValue(document, variablesKey)
+		if node == nil {
+			continue
+		}
+		declared, err := decodeVariables(node)
+		if err != nil {
+			errs = append(errs, withFile(err, paths[i]))
+			continue
+		}
+		for k, v := range declared {
+			variables[k] = v
+		}
+	}
+	for k, v := range overrides {
+		variables[k] = v
+	}
+
+	// Each file is checked on its own so that problems are reported
+	// against the file they are in
+	for i, document := range documents {
+		for j := 0; j+1 < len(document.Content); j += 2 {
+			if document.Content[j].Value == variablesKey {
+				continue
+			}
+			err := interpolateNode(document.Content[j+1], scope{variables: variables})
+			if err != nil {
+				errs = append(errs, withFile(err, paths[i]))
+			}
+		}
+		if fileErrs := checkConfiguration(document); len(fileErrs) > 0 {
+			errs = append(errs, withFile(fileErrs, paths[i]).(errorList)...)
+		}
+	}
+	if len(errs) > 0 {
+		return nil, nil, errs
+	}
+
+	document := map[string]yaml.Node{}
+	if len(documents) > 0 {
+		merged := documents[0]
+		for _, overlay := range documents[1:] {
+			merged = mergeNode(merged, overlay)
+		}
+		err := merged.Decode(&document)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	resources := map[string]ManagedResource{}
+	var vars map[string]interface{}
+	var roles map[string]RoleSpecification
+	var groups map[string]GroupSpecification
+	var hosts map[string]HostSpecification
+	for k, node := range document {
+		if k == variablesKey {
 			continue
 		}
-		if file.Name() == watchedFileName {
-			_, err := emoji.Printf(":white_check_mark: Found configuration file %s\n\n", file.Name())
+		var err error
+		switch k {
+		case varsKey:
+			err = node.Decode(&vars)
+		case rolesKey:
+			err = node.Decode(&roles)
+		case groupsKey:
+			err = node.Decode(&groups)
+		case hostsKey:
+			err = node.Decode(&hosts)
+		default:
+			var resource ManagedResource
+			err = node.Decode(&resource)
+			if err != nil {
+				return nil, nil, fmt.Errorf("resource %s: %s", k, err)
+			}
+			resources[k] = resource
+			continue
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s: %s", k, err)
+		}
+	}
+
+	// Hosts are managed as a resource each, so that state and diffs
+	// are tracked per host
+	expanded, err := expandRoles(roles, groups, hosts)
+	if err != nil {
+		return nil, nil, err
+	}
+	for k, v := range expanded {
+		if _, ok := resources[k]; ok {
+			return nil, nil, fmt.Errorf("resource %s is declared more than once", k)
+		}
+		resources[k] = v
+	}
+	return resources, vars, nil
+}
+
+// mappingValue returns the value of key in a mapping, or nil if it is
+// not set
+func mappingValue(node *yaml.Node, key string) *yaml.Node {
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			return node.Content[i+1]
+		}
+	}
+	return nil
+}
+
+// readOverlay returns the content of an environment overlay, or nil if
+// there isn't one
+func readOverlay(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	_, err = emoji.Printf(":white_check_mark: Found overlay %s\n\n", path)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return data, nil
+}
+
+// renderFile renders a templated file with the variables of the resource
+// declaring it
+func renderFile(name string, resource ManagedResource, file *FileSpecification) error {
+	content, err := localFileContent(*file)
+	if err != nil {
+		return fmt.Errorf("error reading template for %s in %s: %s", file.destination(), name, err)
+	}
+	rendered, err := renderTemplate(file.destination(), content, newTemplateData(name, resource))
+	if err != nil {
+		return fmt.Errorf("error rendering template for %s in %s: %s", file.destination(), name, err)
+	}
+	file.rendered = rendered
+	return nil
+}
+
+// traverseFiles walks the directory tree below root and returns the
+// paths of configuration files found, skipping ignored paths
+func traverseFiles(root string) ([]string, error) {
+	ignorePatterns, err := readIgnoreFile(filepath.Join(root, ignoreFileName))
+	if err != nil {
+		return nil, err
+	}
+	ignorePatterns = append(ignorePatterns, defaultIgnorePatterns...)
+
+	foundFiles := []string{}
+	err = filepath.WalkDir(root, func(path string, file fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		if rel != "." && isIgnored(rel, file.IsDir(), ignorePatterns) {
+			if file.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !file.IsDir() && file.Name() == watchedFileName {
+			_, err := emoji.Printf(":white_check_mark: Found configuration file %s\n\n", path)
 			if err != nil {
 				log.Fatal(err)
 			}
-			foundFiles = append(foundFiles, file)
+			foundFiles = append(foundFiles, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return foundFiles, nil
+}
+
+// readIgnoreFile returns the patterns listed in an ignore file, one per
+// line, skipping blank lines and comments
+func readIgnoreFile(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var patterns []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if _, err := filepath.Match(line, ""); err != nil {
+			return nil, fmt.Errorf("invalid pattern %q in %s: %s", line, path, err)
+		}
+		patterns = append(patterns, line)
+	}
+	return patterns, scanner.Err()
+}
+
+// isIgnored reports whether a path relative to the search root matches
+// any ignore pattern. Patterns without a slash match a name at any depth,
+// patterns with one match from the root, and a trailing slash matches
+// directories only
+func isIgnored(rel string, isDir bool, patterns []string) bool {
+	rel = filepath.ToSlash(rel)
+	for _, pattern := range patterns {
+		if strings.HasSuffix(pattern, "/") {
+			if !isDir {
+				continue
+			}
+			pattern = strings.TrimSuffix(pattern, "/")
+		}
+		name := rel
+		if strings.Contains(pattern, "/") {
+			pattern = strings.TrimPrefix(pattern, "/")
+		} else {
+			name = filepath.Base(rel)
+		}
+		if matched, _ := filepath.Match(pattern, name); matched {
+			return true
 		}
 	}
-	return foundFiles
+	return false
 }
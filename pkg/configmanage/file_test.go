@@ -0,0 +1,357 @@
+package configmanage
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// writeTree creates files below the working directory, creating parent
+// directories as needed
+func writeTree(t *testing.T, files map[string]string) {
+	t.Helper()
+	for path, content := range files {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		writeFile(t, path, content)
+	}
+}
+
+func TestTraverseFiles(t *testing.T) {
+	chdir(t, t.TempDir())
+	writeTree(t, map[string]string{
+		"glue.yaml":                  "",
+		"web/glue.yaml":              "",
+		"web/index.php":              "",
+		"services/db/glue.yaml":      "",
+		"vendor/glue.yaml":           "",
+		"services/vendor/glue.yaml":  "",
+		"services/legacy/glue.yaml":  "",
+		".git/glue.yaml":             "",
+		"examples/glue.yaml/README":  "",
+		ignoreFileName:               "# vendored configuration\nvendor/\n/services/legacy\n",
+		"services/db/glue.yaml.orig": "",
+	})
+
+	got, err := traverseFiles(".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"glue.yaml", "services/db/glue.yaml", "web/glue.yaml"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("traverseFiles() = %v, want %v", got, want)
+	}
+}
+
+func TestIsIgnored(t *testing.T) {
+	tests := []struct {
+		name     string
+		rel      string
+		isDir    bool
+		patterns []string
+		want     bool
+	}{
+		{
+			name:     "A name pattern should match at any depth",
+			rel:      "services/vendor",
+			isDir:    true,
+			patterns: []string{"vendor"},
+			want:     true,
+		},
+		{
+			name:     "A rooted pattern should only match from the root",
+			rel:      "services/legacy",
+			isDir:    true,
+			patterns: []string{"/legacy"},
+			want:     false,
+		},
+		{
+			name:     "A pattern with a slash should match from the root",
+			rel:      "services/legacy",
+			isDir:    true,
+			patterns: []string{"services/*"},
+			want:     true,
+		},
+		{
+			name:     "A directory pattern should not match files",
+			rel:      "build",
+			isDir:    false,
+			patterns: []string{"build/"},
+			want:     false,
+		},
+		{
+			name:     "A glob should match names",
+			rel:      "tmp-1234",
+			isDir:    true,
+			patterns: []string{"tmp-*"},
+			want:     true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isIgnored(tt.rel, tt.isDir, tt.patterns); got != tt.want {
+				t.Errorf("isIgnored() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseConfigurationFile(t *testing.T) {
+	t.Run("Files should be sourced relative to their configuration file", func(t *testing.T) {
+		chdir(t, t.TempDir())
+		writeTree(t, map[string]string{
+			"web/glue.yaml": "web:\n  host: 1.2.3.4\n  files:\n    - name: index.php\n      path: /var/www/html\n",
+			"web/index.php": "<?php phpinfo(); ?>\n",
+		})
+		parsedFileContents, err := parseConfigurationFile(Options{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, err := localFileContent(parsedFileContents[0]["web"].Files[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(content) != "<?php phpinfo(); ?>\n" {
+			t.Errorf("localFileContent() = %q, want content of web/index.php", content)
+		}
+	})
+	t.Run("The working directory should be searched in place of the current directory", func(t *testing.T) {
+		chdir(t, t.TempDir())
+		writeTree(t, map[string]string{
+			"glue.yaml":           "other:\n  host: 5.6.7.8\n",
+			"envs/prod/glue.yaml": "web:\n  host: 1.2.3.4\n  files:\n    - name: index.php\n      path: /var/www/html\n",
+			"envs/prod/index.php": "<?php phpinfo(); ?>\n",
+		})
+		parsedFileContents, err := parseConfigurationFile(Options{WorkDir: "envs/prod"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(parsedFileContents) != 1 || parsedFileContents[0]["web"].Host != "1.2.3.4" {
+			t.Fatalf("parseConfigurationFile() = %v, want only envs/prod/glue.yaml", parsedFileContents)
+		}
+		if _, err := localFileContent(parsedFileContents[0]["web"].Files[0]); err != nil {
+			t.Errorf("localFileContent() error = %s", err)
+		}
+	})
+	t.Run("A configuration file should be used in place of searching", func(t *testing.T) {
+		chdir(t, t.TempDir())
+		writeTree(t, map[string]string{
+			"glue.yaml":    "other:\n  host: 5.6.7.8\n",
+			"staging.yaml": "web:\n  host: 1.2.3.4\n",
+		})
+		parsedFileContents, err := parseConfigurationFile(Options{ConfigFile: "staging.yaml"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(parsedFileContents) != 1 || parsedFileContents[0]["web"].Host != "1.2.3.4" {
+			t.Errorf("parseConfigurationFile() = %v, want only staging.yaml", parsedFileContents)
+		}
+	})
+	t.Run("Templated files should be rendered with file and resource variables", func(t *testing.T) {
+		chdir(t, t.TempDir())
+		writeTree(t, map[string]string{
+			"glue.yaml": `vars:
+  listen_port: 80
+  server_name: example.com
+web:
+  host: 1.2.3.4
+  vars:
+    listen_port: 8080
+  files:
+    - source: nginx.conf.tmpl
+      dest: /etc/nginx/nginx.conf
+      template: true
+`,
+			"nginx.conf.tmpl": "listen {{ .Host }}:{{ .Vars.listen_port }};\nserver_name {{ .Vars.server_name }};\n",
+		})
+		parsedFileContents, err := parseConfigurationFile(Options{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := parsedFileContents[0][varsKey]; ok {
+			t.Errorf("parseConfigurationFile() treated %s as a resource", varsKey)
+		}
+		content, err := localFileContent(parsedFileContents[0]["web"].Files[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := "listen 1.2.3.4:8080;\nserver_name example.com;\n"; string(content) != want {
+			t.Errorf("localFileContent() = %q, want %q", content, want)
+		}
+	})
+	t.Run("A template rendering to nothing should be empty", func(t *testing.T) {
+		chdir(t, t.TempDir())
+		writeTree(t, map[string]string{
+			"glue.yaml":       "web:\n  host: 1.2.3.4\n  vars:\n    enabled: false\n  files:\n    - source: extra.conf.tmpl\n      dest: /etc/nginx/conf.d/extra.conf\n      template: true\n",
+			"extra.conf.tmpl": "{{ if .Vars.enabled }}gzip on;{{ end }}",
+		})
+		parsedFileContents, err := parseConfigurationFile(Options{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, err := localFileContent(parsedFileContents[0]["web"].Files[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(content) != 0 {
+			t.Errorf("localFileContent() = %q, want no content", content)
+		}
+	})
+	t.Run("An environment overlay should be merged over its configuration file", func(t *testing.T) {
+		chdir(t, t.TempDir())
+		writeTree(t, map[string]string{
+			"glue.yaml": `variables:
+  server_name: dev.example.com
+web:
+  host: 10.0.0.1
+  vars:
+    server_name: ${var.server_name}
+  packages:
+    - package: nginx
+      version: 1.18.0
+    - package: curl
+`,
+			"glue.prod.yaml": `variables:
+  server_name: example.com
+web:
+  host: 10.1.0.1
+  packages:
+    - package: nginx
+      version: 1.22.1
+`,
+			"glue.staging.yaml": "web:\n  host: 10.2.0.1\n",
+		})
+		parsedFileContents, err := parseConfigurationFile(Options{Env: "prod"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		web := parsedFileContents[0]["web"]
+		if web.Host != "10.1.0.1" || web.Vars["server_name"] != "example.com" {
+			t.Errorf("parseConfigurationFile() host = %s, server_name = %v, want prod overlay", web.Host, web.Vars["server_name"])
+		}
+		want := []PackageSpecification{{Package: "nginx", Version: "1.22.1"}, {Package: "curl"}}
+		if !reflect.DeepEqual(web.Packages, want) {
+			t.Errorf("parseConfigurationFile() packages = %v, want %v", web.Packages, want)
+		}
+
+		parsedFileContents, err = parseConfigurationFile(Options{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if web := parsedFileContents[0]["web"]; web.Host != "10.0.0.1" {
+			t.Errorf("parseConfigurationFile() host = %s without an environment, want 10.0.0.1", web.Host)
+		}
+	})
+	t.Run("An environment without any overlays should be rejected", func(t *testing.T) {
+		chdir(t, t.TempDir())
+		writeTree(t, map[string]string{
+			"glue.yaml":      "web:\n  host: 10.0.0.1\n",
+			"glue.prod.yaml": "web:\n  host: 10.1.0.1\n",
+		})
+		_, err := parseConfigurationFile(Options{Env: "prdo"})
+		if err == nil || !strings.Contains(err.Error(), "no glue.prdo.yaml overlays were found") {
+			t.Errorf("parseConfigurationFile() error = %v, want no overlays error", err)
+		}
+	})
+	t.Run("An environment that can't be used in file names should be rejected", func(t *testing.T) {
+		chdir(t, t.TempDir())
+		writeTree(t, map[string]string{"glue.yaml": "web:\n  host: 1.2.3.4\n"})
+		_, err := parseConfigurationFile(Options{Env: "../prod"})
+		if err == nil || !strings.Contains(err.Error(), "invalid environment") {
+			t.Errorf("parseConfigurationFile() error = %v, want invalid environment error", err)
+		}
+	})
+	t.Run("A resource declared in two configuration files should be rejected", func(t *testing.T) {
+		chdir(t, t.TempDir())
+		writeTree(t, map[string]string{
+			"a/glue.yaml": "web:\n  host: 1.2.3.4\n",
+			"b/glue.yaml": "web:\n  host: 5.6.7.8\n",
+		})
+		_, err := parseConfigurationFile(Options{})
+		if err == nil || !strings.Contains(err.Error(), "declared in both") {
+			t.Errorf("parseConfigurationFile(Options{}) error = %v, want duplicate resource error", err)
+		}
+	})
+	t.Run("Secrets should be looked up in the secrets file alongside their configuration file", func(t *testing.T) {
+		chdir(t, t.TempDir())
+		t.Setenv(secretsPassphraseEnv, "correct horse")
+		writeTree(t, map[string]string{
+			"web/glue.yaml":    "web:\n  host: 1.2.3.4\n  password: {secret: root_password}\n  files:\n    - dest: /etc/ssl/private/site.key\n      secret: tls_key\n",
+			"web/secrets.yaml": "root_password: web-password\ntls_key: web-key\n",
+			"db/glue.yaml":     "db:\n  host: 1.2.3.5\n  password: {secret: root_password}\n  files:\n    - dest: /etc/ssl/private/site.key\n      secret: tls_key\n",
+			"db/secrets.yaml":  "root_password: db-password\ntls_key: db-key\n",
+			"cache/glue.yaml":  "cache:\n  host: 1.2.3.6\n  password: {secret: root_password}\n",
+		})
+		for _, dir := range []string{"web", "db"} {
+			if err := EncryptSecretsFile(filepath.Join(dir, "secrets.yaml"), filepath.Join(dir, secretsFileName)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		parsedFileContents, err := parseConfigurationFile(Options{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		resources := map[string]ManagedResource{}
+		for _, contents := range parsedFileContents {
+			for k, v := range contents {
+				resources[k] = v
+			}
+		}
+		for name, want := range map[string]string{"web": "web", "db": "db"} {
+			credentials, err := newCredentials(resources[name])
+			if err != nil {
+				t.Fatalf("newCredentials(%s) error = %s", name, err)
+			}
+			if credentials.Password != want+"-password" {
+				t.Errorf("newCredentials(%s) password = %q, want %q", name, credentials.Password, want+"-password")
+			}
+			content, err := localFileContent(resources[name].Files[0])
+			if err != nil {
+				t.Fatalf("localFileContent(%s) error = %s", name, err)
+			}
+			if string(content) != want+"-key" {
+				t.Errorf("localFileContent(%s) = %q, want %q", name, content, want+"-key")
+			}
+		}
+		// Secrets files in other directories are not visible
+		if _, err := newCredentials(resources["cache"]); err == nil || !strings.Contains(err.Error(), "secret root_password not found") {
+			t.Errorf("newCredentials(cache) error = %v, want secret not found", err)
+		}
+	})
+	t.Run("Local paths should be relative to their configuration file", func(t *testing.T) {
+		chdir(t, t.TempDir())
+		writeTree(t, map[string]string{
+			"web/glue.yaml": `web:
+  host: 1.2.3.4
+  auth:
+    method: certificate
+    key: keys/id_ed25519
+    certificate: /etc/ssh/id_ed25519-cert.pub
+  hostKey:
+    knownHosts: ./known_hosts
+    certAuthority: host_ca.pub
+  bastion:
+    host: 1.2.3.5
+    auth:
+      method: key
+      key: keys/bastion
+`,
+		})
+		parsedFileContents, err := parseConfigurationFile(Options{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		credentials, err := newCredentials(parsedFileContents[0]["web"])
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := []string{credentials.KeyFile, credentials.CertificateFile, credentials.KnownHostsFile, credentials.HostCAFile, credentials.Bastion.KeyFile, credentials.Bastion.KnownHostsFile}
+		want := []string{"web/keys/id_ed25519", "/etc/ssh/id_ed25519-cert.pub", "web/known_hosts", "web/host_ca.pub", "web/keys/bastion", "web/known_hosts"}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("newCredentials() paths = %v, want %v", got, want)
+		}
+	})
+}
@@ -0,0 +1,160 @@
+package configmanage
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+
+	"github.com/echoboomer/glueprint/pkg/common"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// The known_hosts file used to verify host keys when a managed resource
+// does not specify one
+var defaultKnownHostsFile string = "~/.ssh/known_hosts"
+
+// newHostKeyCallback returns a callback that verifies host keys against
+// a known_hosts file, optionally recording keys for hosts seen for the
+// first time. When a host CA is configured, host certificates it signed
+// are trusted and plain host keys fall back to the known_hosts file
+func newHostKeyCallback(credentials Credentials) (ssh.HostKeyCallback, error) {
+	if credentials.HostCAFile == "" {
+		return newKnownHostsCallback(credentials)
+	}
+
+	authorities, err := loadHostAuthorities(credentials.HostCAFile)
+	if err != nil {
+		return nil, err
+	}
+	fallback, err := newKnownHostsCallback(credentials)
+	if errors.Is(err, fs.ErrNotExist) {
+		// Hosts without a certificate can't be verified without known hosts
+		fallback = func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+			return fmt.Errorf("host %s did not present a certificate signed by %s", hostname, credentials.HostCAFile)
+		}
+	} else if err != nil {
+		return nil, err
+	}
+
+	checker := &ssh.CertChecker{
+		IsHostAuthority: func(auth ssh.PublicKey, address string) bool {
+			for _, authority := range authorities {
+				if bytes.Equal(authority.Marshal(), auth.Marshal()) {
+					return true
+				}
+			}
+			return false
+		},
+		HostKeyFallback: fallback,
+	}
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		err := checker.CheckHostKey(hostname, remote, key)
+		if _, ok := key.(*ssh.Certificate); ok && err != nil {
+			return fmt.Errorf("host certificate for %s rejected: %s", hostname, err)
+		}
+		return err
+	}, nil
+}
+
+// loadHostAuthorities reads the host CA public keys from a file with one
+// key per line, as found in a CA's .pub file
+func loadHostAuthorities(path string) ([]ssh.PublicKey, error) {
+	data, err := os.ReadFile(common.ExpandHomeDir(path))
+	if err != nil {
+		return nil, fmt.Errorf("error reading host CA file: %s", err)
+	}
+	var authorities []ssh.PublicKey
+	for len(bytes.TrimSpace(data)) > 0 {
+		authority, _, _, rest, err := ssh.ParseAuthorizedKey(data)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing host CA file %s: %s", path, err)
+		}
+		authorities = append(authorities, authority)
+		data = rest
+	}
+	if len(authorities) == 0 {
+		return nil, fmt.Errorf("host CA file %s contains no keys", path)
+	}
+	return authorities, nil
+}
+
+// newKnownHostsCallback returns a callback that verifies host keys
+// against a known_hosts file
+func newKnownHostsCallback(credentials Credentials) (ssh.HostKeyCallback, error) {
+	path := credentials.KnownHostsFile
+	if path == "" {
+		path = defaultKnownHostsFile
+	}
+	path = common.ExpandHomeDir(path)
+
+	if credentials.TrustOnFirstUse {
+		err := createKnownHostsFileIfNotExists(path)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	callback, err := knownhosts.New(path)
+	if err != nil {
+		return nil, fmt.Errorf("error loading known hosts file %s: %w", path, err)
+	}
+
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		err := callback(hostname, remote, key)
+		var keyErr *knownhosts.KeyError
+		if !errors.As(err, &keyErr) {
+			return err
+		}
+		// A known host presenting a different key is never trusted
+		if len(keyErr.Want) > 0 {
+			return fmt.Errorf("host key for %s has changed and no longer matches %s:%d - "+
+				"this could be a man-in-the-middle attack. If the change is expected, remove the old entry and try again",
+				hostname, keyErr.Want[0].Filename, keyErr.Want[0].Line)
+		}
+		if credentials.TrustOnFirstUse {
+			return trustHostKey(path, hostname, key)
+		}
+		return fmt.Errorf("host %s is not present in known hosts file %s - "+
+			"connect to it manually or enable trustOnFirstUse", hostname, path)
+	}, nil
+}
+
+// createKnownHostsFileIfNotExists creates an empty known_hosts file so
+// that new host keys can be recorded
+func createKnownHostsFileIfNotExists(path string) error {
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		err = os.MkdirAll(filepath.Dir(path), 0700)
+		if err != nil {
+			return fmt.Errorf("error creating known hosts file: %s", err)
+		}
+		err = os.WriteFile(path, []byte{}, 0600)
+		if err != nil {
+			return fmt.Errorf("error creating known hosts file: %s", err)
+		}
+	}
+	return nil
+}
+
+// trustHostKey records the key presented by a host in the known_hosts
+// file
+func trustHostKey(path string, hostname string, key ssh.PublicKey) error {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("error opening known hosts file: %s", err)
+	}
+	defer f.Close()
+
+	line := knownhosts.Line([]string{knownhosts.Normalize(hostname)}, key)
+	_, err = fmt.Fprintln(f, line)
+	if err != nil {
+		return fmt.Errorf("error writing to known hosts file: %s", err)
+	}
+	log.Warnf("Permanently added %s (%s) to known hosts file %s", hostname, key.Type(), path)
+	return nil
+}
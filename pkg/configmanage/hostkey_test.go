@@ -0,0 +1,147 @@
+package configmanage
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+func TestKnownHostsCallback(t *testing.T) {
+	const hostname = "web.example.com:22"
+	remote := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 22}
+	hostKey := newTestSigner(t).PublicKey()
+	otherKey := newTestSigner(t).PublicKey()
+	knownLine := knownhosts.Line([]string{knownhosts.Normalize(hostname)}, hostKey) + "\n"
+
+	tests := []struct {
+		name            string
+		knownHosts      *string
+		trustOnFirstUse bool
+		key             ssh.PublicKey
+		wantErr         string
+		wantKnownHosts  string
+	}{
+		{
+			name:           "A host presenting its known key should be trusted",
+			knownHosts:     &knownLine,
+			key:            hostKey,
+			wantKnownHosts: knownLine,
+		},
+		{
+			name:           "An unknown host should be rejected without trust on first use",
+			knownHosts:     new(string),
+			key:            hostKey,
+			wantErr:        "is not present in known hosts file",
+			wantKnownHosts: "",
+		},
+		{
+			name:            "An unknown host should be recorded with trust on first use",
+			knownHosts:      new(string),
+			trustOnFirstUse: true,
+			key:             hostKey,
+			wantKnownHosts:  knownLine,
+		},
+		{
+			name:            "A missing known hosts file should be created with trust on first use",
+			trustOnFirstUse: true,
+			key:             hostKey,
+			wantKnownHosts:  knownLine,
+		},
+		{
+			name:    "A missing known hosts file should be an error without trust on first use",
+			key:     hostKey,
+			wantErr: "error loading known hosts file",
+		},
+		{
+			name:           "A host presenting a changed key should be rejected",
+			knownHosts:     &knownLine,
+			key:            otherKey,
+			wantErr:        "has changed",
+			wantKnownHosts: knownLine,
+		},
+		{
+			name:            "A host presenting a changed key should be rejected with trust on first use",
+			knownHosts:      &knownLine,
+			trustOnFirstUse: true,
+			key:             otherKey,
+			wantErr:         "has changed",
+			wantKnownHosts:  knownLine,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "ssh", "known_hosts")
+			if tt.knownHosts != nil {
+				if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+					t.Fatal(err)
+				}
+				writeFile(t, path, *tt.knownHosts)
+			}
+			credentials := Credentials{KnownHostsFile: path, TrustOnFirstUse: tt.trustOnFirstUse}
+
+			callback, err := newHostKeyCallback(credentials)
+			if err == nil {
+				err = callback(hostname, remote, tt.key)
+			}
+			if tt.wantErr == "" && err != nil {
+				t.Fatalf("host key callback error = %s", err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("host key callback error = %v, want error containing %q", err, tt.wantErr)
+			}
+			if tt.knownHosts == nil && !tt.trustOnFirstUse {
+				return
+			}
+			data, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data) != tt.wantKnownHosts {
+				t.Errorf("known hosts file = %q, want %q", data, tt.wantKnownHosts)
+			}
+		})
+	}
+}
+
+func TestTrustOnFirstUse(t *testing.T) {
+	server := newTestSSHServer(t)
+	defer connections.closeAll()
+
+	// The first connection records the key, and later connections are
+	// verified against it
+	knownHosts := filepath.Join(t.TempDir(), "known_hosts")
+	credentials := Credentials{
+		Hostname:        server.Host,
+		Port:            server.Port,
+		Username:        testServerUser,
+		Password:        testServerPassword,
+		KnownHostsFile:  knownHosts,
+		TrustOnFirstUse: true,
+	}
+	if _, err := RunOnRemoteHost(credentials, "true"); err != nil {
+		t.Fatalf("RunOnRemoteHost() error = %s", err)
+	}
+	connections.closeAll()
+
+	data, err := os.ReadFile(knownHosts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := os.ReadFile(server.KnownHosts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != string(want) {
+		t.Errorf("known hosts file = %q, want %q", data, want)
+	}
+
+	credentials.TrustOnFirstUse = false
+	if _, err := RunOnRemoteHost(credentials, "true"); err != nil {
+		t.Errorf("RunOnRemoteHost() with the recorded key error = %s", err)
+	}
+}
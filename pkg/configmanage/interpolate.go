@@ -0,0 +1,195 @@
+package configmanage
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// The top level key in a configuration file holding variables that can
+// be interpolated into any string in it, which can't be used as a
+// resource name
+var variablesKey string = "variables"
+
+// Matches ${var.name}, ${input.name} and ${env.NAME} references, and $${
+// which escapes a literal ${
+var interpolationPattern = regexp.MustCompile(`\$\$\{|\$\{(var|input|env)\.([A-Za-z0-9_-]+)\}`)
+
+// The keys of a resource's files and of their inline content, which is
+// written to the state file and so can't be read from the environment
+var filesKey string = "files"
+var contentKey string = "content"
+
+// variable is the value of a variable, and whether it was read from the
+// environment
+type variable struct {
+	value   string
+	fromEnv bool
+}
+
+// scope holds the values that references can be interpolated from -
+// variables in configuration files and inputs in modules
+type scope struct {
+	variables map[string]variable
+	inputs    map[string]string
+	// files is set while interpolating a list of files, and content
+	// while interpolating a file's inline content
+	files   bool
+	content bool
+}
+
+// interpolateString replaces variable, input and environment references
+// in s
+func interpolateString(s string, scope scope) (string, error) {
+	var err error
+	out := interpolationPattern.ReplaceAllStringFunc(s, func(match string) string {
+		if match == "$${" {
+			return "${"
+		}
+		parts := interpolationPattern.FindStringSubmatch(match)
+		switch parts[1] {
+		case "var":
+			v, ok := scope.variables[parts[2]]
+			if !ok && err == nil {
+				err = fmt.Errorf("variable %s is not defined", parts[2])
+			}
+			if v.fromEnv && scope.content && err == nil {
+				err = fmt.Errorf("variable %s is read from the environment and can't be used in inline content, which is written to the state file - use secret instead", parts[2])
+			}
+			return v.value
+		case "input":
+			value, ok := scope.inputs[parts[2]]
+			if scope.inputs == nil && err == nil {
+				err = fmt.Errorf("input %s can only be referenced in a module", parts[2])
+			} else if !ok && err == nil {
+				err = fmt.Errorf("input %s is not declared by the module", parts[2])
+			}
+			return value
+		default:
+			if scope.content {
+				if err == nil {
+					err = fmt.Errorf("environment variable %s can't be referenced in inline content, which is written to the state file - use secret instead", parts[2])
+				}
+				return match
+			}
+			value, ok := os.LookupEnv(parts[2])
+			if !ok && err == nil {
+				err = fmt.Errorf("environment variable %s is not set", parts[2])
+			}
+			return value
+		}
+	})
+	return out, err
+}
+
+// interpolateNode replaces references in every string below node,
+// reporting every reference that can't be replaced
+func interpolateNode(node *yaml.Node, scope scope) error {
+	if node.Kind == yaml.ScalarNode {
+		value, err := interpolateString(node.Value, scope)
+		if err != nil {
+			return newConfigError(node, "%s", err)
+		}
+		if value != node.Value {
+			node.Value = value
+			// Unquoted values are resolved again so that numbers and
+			// booleans keep their type
+			if node.Style == 0 {
+				node.Tag = ""
+			}
+		}
+		return nil
+	}
+	var errs errorList
+	for i, child := range node.Content {
+		childScope := scope
+		if node.Kind == yaml.MappingNode {
+			// Values are interpolated knowing which key they belong to
+			key := node.Content[i-i%2].Value
+			childScope.files = i%2 == 1 && key == filesKey
+			childScope.content = i%2 == 1 && scope.files && key == contentKey
+		}
+		err := interpolateNode(child, childScope)
+		if list, ok := err.(errorList); ok {
+			errs = append(errs, list...)
+		} else if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errs.err()
+}
+
+// decodeVariables reads a variables block, a map of names to scalar
+// values which may reference the environment
+func decodeVariables(node *yaml.Node) (map[string]variable, error) {
+	if node.Kind != yaml.MappingNode {
+		return nil, newConfigError(node, "%s must be a map of names to values", variablesKey)
+	}
+	variables := map[string]variable{}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		key, value := node.Content[i], node.Content[i+1]
+		if value.Kind != yaml.ScalarNode {
+			return nil, newConfigError(value, "variable %s must be a single value", key.Value)
+		}
+		variables[key.Value] = variable{fromEnv: referencesEnvironment(value.Value)}
+	}
+	err := interpolateNode(node, scope{})
+	if err != nil {
+		return nil, err
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		v := variables[node.Content[i].Value]
+		v.value = node.Content[i+1].Value
+		variables[node.Content[i].Value] = v
+	}
+	return variables, nil
+}
+
+// referencesEnvironment reports whether s references an environment
+// variable
+func referencesEnvironment(s string) bool {
+	for _, parts := range interpolationPattern.FindAllStringSubmatch(s, -1) {
+		if parts[1] == "env" {
+			return true
+		}
+	}
+	return false
+}
+
+// variableOverrides returns the variables set on the command line, with
+// those given directly taking precedence over those in files
+func variableOverrides(opts Options) (map[string]variable, error) {
+	overrides := map[string]variable{}
+	for _, path := range opts.VarFiles {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("error reading variables file: %s", err)
+		}
+		var document yaml.Node
+		err = yaml.Unmarshal(data, &document)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing variables file %s: %s", path, err)
+		}
+		if len(document.Content) == 0 {
+			continue
+		}
+		variables, err := decodeVariables(document.Content[0])
+		if err != nil {
+			return nil, fmt.Errorf("error parsing variables file %s: %s", path, err)
+		}
+		for k, v := range variables {
+			overrides[k] = v
+		}
+	}
+	for _, v := range opts.Vars {
+		i := strings.Index(v, "=")
+		if i < 1 {
+			return nil, fmt.Errorf("invalid variable %q, expected name=value", v)
+		}
+		overrides[v[:i]] = variable{value: v[i+1:]}
+	}
+	return overrides, nil
+}
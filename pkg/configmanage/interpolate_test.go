@@ -0,0 +1,302 @@
+package configmanage
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestInterpolateString(t *testing.T) {
+	t.Setenv("GLUE_TEST_DOCROOT", "/srv/www")
+	variables := map[string]variable{
+		"web_ip":      {value: "10.0.0.5"},
+		"php-version": {value: "2:8.1"},
+		"token":       {value: "s3cret", fromEnv: true},
+	}
+
+	tests := []struct {
+		name    string
+		s       string
+		content bool
+		want    string
+		wantErr string
+	}{
+		{
+			name: "Variables should be replaced",
+			s:    "${var.web_ip}",
+			want: "10.0.0.5",
+		},
+		{
+			name: "References should be replaced within a string",
+			s:    "/srv/www/html on ${var.web_ip}, php ${var.php-version}",
+			want: "/srv/www/html on 10.0.0.5, php 2:8.1",
+		},
+		{
+			name: "Environment variables should be replaced",
+			s:    "${env.GLUE_TEST_DOCROOT}/html",
+			want: "/srv/www/html",
+		},
+		{
+			name:    "Environment variables in inline content should be an error",
+			s:       "${env.GLUE_TEST_DOCROOT}/html",
+			content: true,
+			wantErr: "environment variable GLUE_TEST_DOCROOT can't be referenced in inline content",
+		},
+		{
+			name:    "Variables read from the environment in inline content should be an error",
+			s:       "token=${var.token}",
+			content: true,
+			wantErr: "variable token is read from the environment and can't be used in inline content",
+		},
+		{
+			name: "Other references should be left alone",
+			s:    "${HOME}/bin $PATH",
+			want: "${HOME}/bin $PATH",
+		},
+		{
+			name: "An escaped reference should be left as written",
+			s:    "$${var.web_ip}",
+			want: "${var.web_ip}",
+		},
+		{
+			name:    "An undefined variable should be an error",
+			s:       "${var.db_ip}",
+			wantErr: "variable db_ip is not defined",
+		},
+		{
+			name:    "An input outside a module should be an error",
+			s:       "${input.port}",
+			wantErr: "input port can only be referenced in a module",
+		},
+		{
+			name:    "An unset environment variable should be an error",
+			s:       "${env.GLUE_TEST_UNSET}",
+			wantErr: "environment variable GLUE_TEST_UNSET is not set",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := interpolateString(tt.s, scope{variables: variables, content: tt.content})
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("interpolateString() error = %v, want error containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("interpolateString() error = %s", err)
+			}
+			if got != tt.want {
+				t.Errorf("interpolateString() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDecodeConfigurationVariables(t *testing.T) {
+	chdir(t, t.TempDir())
+	writeFile(t, "prod.yaml", "web_ip: 10.0.0.9\nssh_port: 2200\n")
+
+	config := `variables:
+  web_ip: 10.0.0.5
+  ssh_port: 22
+  docroot: /srv/www
+web:
+  host: ${var.web_ip}
+  port: ${var.ssh_port}
+  files:
+    - name: index.php
+      path: ${var.docroot}/html
+  packages:
+    - package: php
+      version: "${var.php_version}"
+`
+	tests := []struct {
+		name     string
+		opts     Options
+		wantHost string
+		wantPort int
+		wantErr  string
+	}{
+		{
+			name:    "A variable that is not defined should be an error",
+			opts:    Options{},
+			wantErr: "glue.yaml:13:16: variable php_version is not defined",
+		},
+		{
+			name:     "Variables set on the command line should be interpolated",
+			opts:     Options{Vars: []string{"php_version=2:8.1"}},
+			wantHost: "10.0.0.5",
+			wantPort: 22,
+		},
+		{
+			name:     "Variables files should override the configuration file",
+			opts:     Options{Vars: []string{"php_version=2:8.1"}, VarFiles: []string{"prod.yaml"}},
+			wantHost: "10.0.0.9",
+			wantPort: 2200,
+		},
+		{
+			name:     "Variables set directly should override variables files",
+			opts:     Options{Vars: []string{"php_version=2:8.1", "web_ip=10.0.0.10"}, VarFiles: []string{"prod.yaml"}},
+			wantHost: "10.0.0.10",
+			wantPort: 2200,
+		},
+		{
+			name:    "A variable without a value should be rejected",
+			opts:    Options{Vars: []string{"php_version"}},
+			wantErr: "expected name=value",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			overrides, err := variableOverrides(tt.opts)
+			var resources map[string]ManagedResource
+			if err == nil {
+				resources, _, err = decodeConfiguration([]configurationSource{{path: watchedFileName, data: []byte(config)}}, overrides)
+			}
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("decodeConfiguration() error = %v, want error containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("decodeConfiguration() error = %s", err)
+			}
+			web := resources["web"]
+			if web.Host != tt.wantHost || web.Port != tt.wantPort {
+				t.Errorf("decodeConfiguration() host = %s:%d, want %s:%d", web.Host, web.Port, tt.wantHost, tt.wantPort)
+			}
+			if got := filepath.ToSlash(web.Files[0].Path); got != "/srv/www/html" {
+				t.Errorf("decodeConfiguration() path = %s, want /srv/www/html", got)
+			}
+			if web.Packages[0].Version != "2:8.1" {
+				t.Errorf("decodeConfiguration() version = %s, want 2:8.1", web.Packages[0].Version)
+			}
+			if _, ok := resources[variablesKey]; ok {
+				t.Errorf("decodeConfiguration() treated %s as a resource", variablesKey)
+			}
+		})
+	}
+}
+
+func TestEnvironmentReferences(t *testing.T) {
+	t.Setenv("GLUE_TEST_PASSWORD", "s3cret-from-env")
+	t.Setenv("GLUE_TEST_HOST", "10.0.0.7")
+
+	tests := []struct {
+		name     string
+		config   string
+		wantHost string
+		wantErr  string
+	}{
+		{
+			name: "Environment variables should be allowed in passwords and passphrases",
+			config: `web:
+  host: 10.0.0.5
+  password: ${env.GLUE_TEST_PASSWORD}
+  becomePassword: ${env.GLUE_TEST_PASSWORD}
+  auth:
+    method: key
+    key: ~/.ssh/id_ed25519
+    passphrase: ${env.GLUE_TEST_PASSWORD}
+  bastion:
+    host: 10.0.0.1
+    password: ${env.GLUE_TEST_PASSWORD}
+    bastion:
+      host: 10.0.0.2
+      password: ${env.GLUE_TEST_PASSWORD}
+groups:
+  app:
+    hosts: [10.0.1.1]
+    password: ${env.GLUE_TEST_PASSWORD}
+hosts:
+  db:
+    host: 10.0.2.1
+    password: ${env.GLUE_TEST_PASSWORD}
+`,
+		},
+		{
+			name: "Environment variables should be allowed in any other string",
+			config: `variables:
+  docroot: ${env.GLUE_TEST_HOST}
+web:
+  host: ${env.GLUE_TEST_HOST}
+  password: ${env.GLUE_TEST_PASSWORD}
+  command: ['echo', '${env.GLUE_TEST_HOST}']
+  files:
+    - dest: /srv/${var.docroot}/index.html
+      source: index.html
+`,
+			wantHost: "10.0.0.7",
+		},
+		{
+			name:    "Environment variables should not be allowed in inline content",
+			config:  "web:\n  host: 10.0.0.5\n  files:\n    - dest: /etc/app.conf\n      content: token=${env.GLUE_TEST_PASSWORD}\n",
+			wantErr: "glue.yaml:5:16: environment variable GLUE_TEST_PASSWORD can't be referenced in inline content",
+		},
+		{
+			name:    "Variables read from the environment should not be allowed in inline content",
+			config:  "variables:\n  token: ${env.GLUE_TEST_PASSWORD}\nroles:\n  app:\n    files:\n      - dest: /etc/app.conf\n        content: token=${var.token}\n",
+			wantErr: "glue.yaml:7:18: variable token is read from the environment and can't be used in inline content",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resources, _, err := decodeConfiguration([]configurationSource{{path: watchedFileName, data: []byte(tt.config)}}, nil)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("decodeConfiguration() error = %v, want error containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("decodeConfiguration() error = %s", err)
+			}
+			credentials, err := newCredentials(resources["web"])
+			if err != nil {
+				t.Fatal(err)
+			}
+			if credentials.Password != "s3cret-from-env" || credentials.Bastion != nil && credentials.Bastion.Bastion.Password != "s3cret-from-env" {
+				t.Errorf("newCredentials() did not resolve passwords from the environment")
+			}
+			if tt.wantHost != "" {
+				web := resources["web"]
+				if web.Host != tt.wantHost || web.Command[1] != tt.wantHost || web.Files[0].Dest != "/srv/10.0.0.7/index.html" {
+					t.Errorf("decodeConfiguration() host = %s, command = %v, dest = %s, want %s from the environment", web.Host, web.Command, web.Files[0].Dest, tt.wantHost)
+				}
+			}
+		})
+	}
+}
+
+func TestEnvironmentReferencesNotWrittenToState(t *testing.T) {
+	chdir(t, t.TempDir())
+	t.Setenv("GLUE_TEST_PASSWORD", "s3cret-from-env")
+	writeFile(t, watchedFileName, `web:
+  host: 10.0.0.5
+  password: ${env.GLUE_TEST_PASSWORD}
+  bastion:
+    host: 10.0.0.1
+    password: ${env.GLUE_TEST_PASSWORD}
+  command: ['service', 'nginx', 'reload']
+`)
+	parsedFileContents, err := parseConfigurationFile(Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	CreateStateFileIfNotExists(stateFileName)
+	WriteToState(stateFileName, parsedFileContents[0])
+
+	state, err := os.ReadFile(stateFileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(state), "s3cret-from-env") {
+		t.Errorf("state file contains a value read from the environment:\n%s", state)
+	}
+	if !strings.Contains(string(state), "reload") {
+		t.Errorf("state file does not contain web:\n%s", state)
+	}
+}
@@ -0,0 +1,74 @@
+package configmanage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// localTransport performs work on the machine glueprint runs on without
+// going through ssh
+type localTransport struct {
+	credentials Credentials
+}
+
+// Run executes a command with the local shell - output is returned even
+// when the command exits with a non-zero status
+func (t *localTransport) Run(command string, stdin io.Reader) (CommandResult, error) {
+	ctx := context.Background()
+	timeout := t.credentials.CommandTimeout
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	output := newCommandOutput(t.credentials, os.Stdout)
+	cmd := exec.CommandContext(ctx, "sh", "-c", command)
+	cmd.Stdin = stdin
+	cmd.Stdout = output.Stdout()
+	cmd.Stderr = output.Stderr()
+	start := time.Now()
+	err := cmd.Run()
+	exitStatus := 0
+	var exitErr *exec.ExitError
+	if ctx.Err() == context.DeadlineExceeded {
+		err = fmt.Errorf("command timed out after %s", timeout)
+		log.Errorf("Error executing command on host: %s", err)
+		exitStatus = -1
+	} else if errors.As(err, &exitErr) {
+		exitStatus = exitErr.ExitCode()
+	} else if err != nil {
+		log.Errorf("Error executing command on host: %s", err)
+		exitStatus = -1
+	}
+	return output.Result(exitStatus, time.Since(start)), err
+}
+
+// PutFile writes content to a local file
+func (t *localTransport) PutFile(path string, content io.Reader) (int64, error) {
+	dstFile, err := os.Create(path)
+	if err != nil {
+		return 0, err
+	}
+	defer dstFile.Close()
+
+	return io.Copy(dstFile, content)
+}
+
+// GetFile reads a local file
+func (t *localTransport) GetFile(path string) ([]byte, error) {
+	return os.ReadFile(path)
+}
+
+// Stat describes a local file
+func (t *localTransport) Stat(path string) (fs.FileInfo, error) {
+	return os.Stat(path)
+}
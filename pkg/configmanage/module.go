@@ -0,0 +1,171 @@
+package configmanage
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/echoboomer/glueprint/pkg/common"
+	"gopkg.in/yaml.v3"
+)
+
+// The file describing a module in its directory
+var moduleFileName string = "module.yaml"
+
+// UnmarshalYAML accepts either the path of a module or a mapping with
+// the module and its inputs
+func (c *ModuleCall) UnmarshalYAML(node *yaml.Node) error {
+	c.Line = node.Line
+	if node.Kind == yaml.ScalarNode {
+		c.Module = node.Value
+		return nil
+	}
+	type moduleCall ModuleCall
+	var call moduleCall
+	err := strictDecode(node, &call)
+	if err != nil {
+		return err
+	}
+	c.Module = call.Module
+	c.Inputs = call.Inputs
+	return nil
+}
+
+// expandModules adds the files, packages, command and variables of the
+// modules used by a resource, ahead of those declared on the resource
+// itself. Module paths are relative to dir
+func expandModules(resource ManagedResource, dir string) (ManagedResource, error) {
+	if len(resource.Use) == 0 {
+		return resource, nil
+	}
+	used, err := loadModules(resource.Use, dir, nil)
+	if err != nil {
+		return ManagedResource{}, err
+	}
+	resource.Files = append(used.Files, resource.Files...)
+	resource.Packages = append(used.Packages, resource.Packages...)
+	resource.Command = joinCommands(used.Command, resource.Command)
+	resource.Vars = mergeVars(used.Vars, resource.Vars)
+	return resource, nil
+}
+
+// loadModules loads each module called, along with any modules they use
+// in turn. stack holds the modules being loaded so that cycles are found
+func loadModules(calls []ModuleCall, dir string, stack []string) (RoleSpecification, error) {
+	var used RoleSpecification
+	for _, call := range calls {
+		path := common.ExpandHomeDir(call.Module)
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(dir, path)
+		}
+		for _, loading := range stack {
+			if loading == path {
+				return RoleSpecification{}, fmt.Errorf("module %s used at line %d: module uses itself through %s",
+					call.Module, call.Line, strings.Join(append(stack, path), " -> "))
+			}
+		}
+
+		module, err := loadModule(call, path)
+		if err != nil {
+			return RoleSpecification{}, fmt.Errorf("module %s used at line %d: %s", call.Module, call.Line, err)
+		}
+		nested, err := loadModules(module.Use, path, append(stack, path))
+		if err != nil {
+			return RoleSpecification{}, fmt.Errorf("module %s used at line %d: %s", call.Module, call.Line, err)
+		}
+		// Files are sourced relative to the module
+		for i := range module.Files {
+			module.Files[i].Dir = path
+		}
+
+		used.Files = append(append(used.Files, nested.Files...), module.Files...)
+		used.Packages = append(append(used.Packages, nested.Packages...), module.Packages...)
+		used.Command = joinCommands(used.Command, joinCommands(nested.Command, module.Command))
+		used.Vars = mergeVars(used.Vars, mergeVars(nested.Vars, module.Vars))
+	}
+	return used, nil
+}
+
+// loadModule reads the module in dir and interpolates the inputs it is
+// called with
+func loadModule(call ModuleCall, dir string) (ModuleSpecification, error) {
+	path := filepath.Join(dir, moduleFileName)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return ModuleSpecification{}, fmt.Errorf("error reading module: %s", err)
+	}
+	var document yaml.Node
+	err = yaml.Unmarshal(data, &document)
+	if err != nil {
+		return ModuleSpecification{}, syntaxError(err, path)
+	}
+	if len(document.Content) == 0 {
+		return ModuleSpecification{}, nil
+	}
+	root := document.Content[0]
+
+	// Inputs are declared before they are interpolated into the rest of
+	// the module
+	var declared map[string]InputSpecification
+	if node := mappingValue(root, "inputs"); node != nil {
+		if errs := decodeKnownFields(node, &map[string]InputSpecification{}); len(errs) > 0 {
+			return ModuleSpecification{}, withFile(errs, path)
+		}
+		err = node.Decode(&declared)
+		if err != nil {
+			return ModuleSpecification{}, fmt.Errorf("error parsing %s: %s", path, err)
+		}
+	}
+	inputs, err := moduleInputs(declared, call.Inputs)
+	if err != nil {
+		return ModuleSpecification{}, err
+	}
+
+	err = interpolateNode(root, scope{inputs: inputs})
+	if err != nil {
+		return ModuleSpecification{}, withFile(err, path)
+	}
+	if errs := decodeKnownFields(root, &ModuleSpecification{}); len(errs) > 0 {
+		return ModuleSpecification{}, withFile(errs, path)
+	}
+	var module ModuleSpecification
+	err = root.Decode(&module)
+	if err != nil {
+		return ModuleSpecification{}, fmt.Errorf("error parsing %s: %s", path, err)
+	}
+	return module, nil
+}
+
+// moduleInputs returns the value of every input a module declares, from
+// those given or their defaults
+func moduleInputs(declared map[string]InputSpecification, given map[string]string) (map[string]string, error) {
+	var unknown []string
+	for name := range given {
+		if _, ok := declared[name]; !ok {
+			unknown = append(unknown, name)
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return nil, fmt.Errorf("module has no inputs named %s", strings.Join(unknown, ", "))
+	}
+
+	inputs := map[string]string{}
+	var missing []string
+	for name, input := range declared {
+		if value, ok := given[name]; ok {
+			inputs[name] = value
+		} else if input.Default != nil {
+			inputs[name] = *input.Default
+		} else {
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		return nil, fmt.Errorf("required inputs %s were not given", strings.Join(missing, ", "))
+	}
+	return inputs, nil
+}
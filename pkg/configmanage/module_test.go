@@ -0,0 +1,124 @@
+package configmanage
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// Modules shared by the module tests
+var testModules = map[string]string{
+	"modules/base/module.yaml": `packages:
+  - package: curl
+`,
+	"modules/apache/module.yaml": `inputs:
+  port:
+    description: Port apache listens on
+    default: 80
+  server_name:
+    description: Name of the virtual host
+use:
+  - ../base
+files:
+  - source: ports.conf.tmpl
+    dest: /etc/apache2/ports.conf
+    template: true
+packages:
+  - package: apache2
+command: ['service', 'apache2', 'restart']
+vars:
+  port: ${input.port}
+  server_name: ${input.server_name}
+`,
+	"modules/apache/ports.conf.tmpl": "Listen {{ .Vars.port }}\nServerName {{ .Vars.server_name }}\n",
+	"modules/typo/module.yaml":       "packages:\n  - package: curl\n    verison: 7.88.1\n",
+	"modules/loop/module.yaml": `use:
+  - ../loop
+`,
+}
+
+func TestExpandModules(t *testing.T) {
+	chdir(t, t.TempDir())
+	writeTree(t, testModules)
+	writeTree(t, map[string]string{
+		"glue.yaml": `web:
+  host: 1.2.3.4
+  use:
+    - module: ./modules/apache
+      inputs:
+        port: 8080
+        server_name: example.com
+  packages:
+    - package: php
+`,
+	})
+
+	parsedFileContents, err := parseConfigurationFile(Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	web := parsedFileContents[0]["web"]
+
+	want := []PackageSpecification{{Package: "curl"}, {Package: "apache2"}, {Package: "php"}}
+	if !reflect.DeepEqual(web.Packages, want) {
+		t.Errorf("expandModules() packages = %v, want %v", web.Packages, want)
+	}
+	if want := []string{"service", "apache2", "restart"}; !reflect.DeepEqual(web.Command, want) {
+		t.Errorf("expandModules() command = %v, want %v", web.Command, want)
+	}
+	if web.Vars["port"] != 8080 {
+		t.Errorf("expandModules() port = %#v, want 8080", web.Vars["port"])
+	}
+	content, err := localFileContent(web.Files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "Listen 8080\nServerName example.com\n"; string(content) != want {
+		t.Errorf("localFileContent() = %q, want %q", content, want)
+	}
+}
+
+func TestExpandModulesErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		use     string
+		wantErr string
+	}{
+		{
+			name:    "A required input that is not given should be an error",
+			use:     "    - ./modules/apache\n",
+			wantErr: "resource web: module ./modules/apache used at line 4: required inputs server_name were not given",
+		},
+		{
+			name:    "An input the module does not declare should be an error",
+			use:     "    - module: ./modules/apache\n      inputs:\n        server_name: example.com\n        listen: 8080\n",
+			wantErr: "module has no inputs named listen",
+		},
+		{
+			name:    "A module that does not exist should be an error",
+			use:     "    - ./modules/nginx\n",
+			wantErr: "module ./modules/nginx used at line 4: error reading module",
+		},
+		{
+			name:    "An unknown field in a module should be reported with its position",
+			use:     "    - ./modules/typo\n",
+			wantErr: "modules/typo/module.yaml:3:5: field verison not found in type configmanage.PackageSpecification",
+		},
+		{
+			name:    "A module that uses itself should be an error",
+			use:     "    - ./modules/loop\n",
+			wantErr: "module uses itself",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			chdir(t, t.TempDir())
+			writeTree(t, testModules)
+			writeTree(t, map[string]string{"glue.yaml": "web:\n  host: 1.2.3.4\n  use:\n" + tt.use})
+			_, err := parseConfigurationFile(Options{})
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("parseConfigurationFile() error = %v, want error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
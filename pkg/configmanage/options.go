@@ -0,0 +1,48 @@
+package configmanage
+
+import "path/filepath"
+
+// Options controls how a run behaves and is usually populated from
+// command line flags
+type Options struct {
+	// Stream prints command output line by line, prefixed with the host
+	// it came from, as it is produced
+	Stream bool
+	// ConfigFile is a single configuration file to use in place of
+	// searching WorkDir for glue.yaml files
+	ConfigFile string
+	// StateFile defaults to glueprint-state.json in WorkDir, or
+	// glueprint-state.<env>.json when Env is set
+	StateFile string
+	// WorkDir is the directory searched for configuration files and
+	// defaults to the current directory
+	WorkDir string
+	// Vars overrides variables in configuration files, each given as
+	// name=value
+	Vars []string
+	// VarFiles are YAML files of variables that override those in
+	// configuration files
+	VarFiles []string
+	// Env selects the glue.<env>.yaml overlays merged over each
+	// configuration file, and its own state file
+	Env string
+}
+
+// workDir returns the directory configuration is read from
+func (o Options) workDir() string {
+	if o.WorkDir == "" {
+		return "."
+	}
+	return o.WorkDir
+}
+
+// stateFile returns the path of the state file
+func (o Options) stateFile() string {
+	if o.StateFile == "" && o.Env != "" {
+		return filepath.Join(o.workDir(), environmentFile(stateFileName, o.Env))
+	}
+	if o.StateFile == "" {
+		return filepath.Join(o.workDir(), stateFileName)
+	}
+	return o.StateFile
+}
@@ -0,0 +1,42 @@
+package configmanage
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestOptionsStateFile(t *testing.T) {
+	tests := []struct {
+		name string
+		opts Options
+		want string
+	}{
+		{
+			name: "The state file should default to the current directory",
+			opts: Options{},
+			want: stateFileName,
+		},
+		{
+			name: "The state file should default to the working directory",
+			opts: Options{WorkDir: "envs/prod"},
+			want: filepath.Join("envs/prod", stateFileName),
+		},
+		{
+			name: "Each environment should have its own state file",
+			opts: Options{WorkDir: "envs", Env: "prod"},
+			want: filepath.Join("envs", "glueprint-state.prod.json"),
+		},
+		{
+			name: "A state file should be used as given",
+			opts: Options{WorkDir: "envs/prod", StateFile: "/var/lib/glueprint/prod.json", Env: "prod"},
+			want: "/var/lib/glueprint/prod.json",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.opts.stateFile(); got != tt.want {
+				t.Errorf("stateFile() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
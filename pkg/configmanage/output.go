@@ -0,0 +1,118 @@
+package configmanage
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"time"
+)
+
+// CommandResult describes a command that has run on a managed resource
+type CommandResult struct {
+	Stdout     string
+	Stderr     string
+	ExitStatus int
+	Duration   time.Duration
+	// Streamed is set when the output has already been shown line by
+	// line while the command ran
+	Streamed bool
+}
+
+// printOutput shows the output of a command unless it was already
+// streamed while the command ran
+func printOutput(result CommandResult) {
+	if result.Streamed {
+		return
+	}
+	if result.Stdout != "" {
+		fmt.Println(result.Stdout)
+	}
+	if result.Stderr != "" {
+		fmt.Println(result.Stderr)
+	}
+}
+
+// prefixWriter writes each complete line it receives to out, prefixed
+// with the host it came from
+type prefixWriter struct {
+	prefix string
+	out    io.Writer
+	buf    []byte
+}
+
+func newPrefixWriter(host string, out io.Writer) *prefixWriter {
+	if host == "" {
+		host = "localhost"
+	}
+	return &prefixWriter{prefix: fmt.Sprintf("[%s] ", host), out: out}
+}
+
+func (w *prefixWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			break
+		}
+		if _, err := fmt.Fprintf(w.out, "%s%s\n", w.prefix, w.buf[:i]); err != nil {
+			return 0, err
+		}
+		w.buf = w.buf[i+1:]
+	}
+	return len(p), nil
+}
+
+// Flush writes any trailing output that did not end with a newline
+func (w *prefixWriter) Flush() {
+	if len(w.buf) > 0 {
+		fmt.Fprintf(w.out, "%s%s\n", w.prefix, w.buf)
+		w.buf = nil
+	}
+}
+
+// commandOutput collects the output of a command, streaming it as it is
+// produced when requested
+type commandOutput struct {
+	stdout, stderr       bytes.Buffer
+	streamOut, streamErr *prefixWriter
+}
+
+func newCommandOutput(credentials Credentials, out io.Writer) *commandOutput {
+	o := &commandOutput{}
+	if credentials.Stream {
+		o.streamOut = newPrefixWriter(credentials.Hostname, out)
+		o.streamErr = newPrefixWriter(credentials.Hostname, out)
+	}
+	return o
+}
+
+// Stdout returns the writer to attach to a command's stdout
+func (o *commandOutput) Stdout() io.Writer {
+	if o.streamOut != nil {
+		return io.MultiWriter(&o.stdout, o.streamOut)
+	}
+	return &o.stdout
+}
+
+// Stderr returns the writer to attach to a command's stderr
+func (o *commandOutput) Stderr() io.Writer {
+	if o.streamErr != nil {
+		return io.MultiWriter(&o.stderr, o.streamErr)
+	}
+	return &o.stderr
+}
+
+// Result completes the output of a command that took duration to run
+func (o *commandOutput) Result(exitStatus int, duration time.Duration) CommandResult {
+	if o.streamOut != nil {
+		o.streamOut.Flush()
+		o.streamErr.Flush()
+	}
+	return CommandResult{
+		Stdout:     o.stdout.String(),
+		Stderr:     o.stderr.String(),
+		ExitStatus: exitStatus,
+		Duration:   duration,
+		Streamed:   o.streamOut != nil,
+	}
+}
@@ -0,0 +1,49 @@
+package configmanage
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestPrefixWriter(t *testing.T) {
+	tests := []struct {
+		name   string
+		host   string
+		writes []string
+		want   string
+	}{
+		{
+			name:   "Each complete line should be prefixed with the host",
+			host:   "1.2.3.4",
+			writes: []string{"Reading package lists...\nBuilding dependency tree...\n"},
+			want:   "[1.2.3.4] Reading package lists...\n[1.2.3.4] Building dependency tree...\n",
+		},
+		{
+			name:   "Lines split across writes should be joined before being prefixed",
+			host:   "1.2.3.4",
+			writes: []string{"Setting up ", "apache2", " ...\nDone"},
+			want:   "[1.2.3.4] Setting up apache2 ...\n[1.2.3.4] Done\n",
+		},
+		{
+			name:   "A local host should be prefixed as localhost",
+			host:   "",
+			writes: []string{"ok\n"},
+			want:   "[localhost] ok\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			w := newPrefixWriter(tt.host, &out)
+			for _, s := range tt.writes {
+				if _, err := w.Write([]byte(s)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			w.Flush()
+			if got := out.String(); got != tt.want {
+				t.Errorf("prefixWriter wrote %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
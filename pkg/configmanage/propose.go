@@ -11,70 +11,91 @@ import (
 
 // Propose determines what changes need to be made and clearly describes
 // them
-func Propose() {
+func Propose(opts Options) error {
 	// Parse contents of the configuration file
-	parsedFileContents, err := parseConfigurationFile()
+	parsedFileContents, err := parseConfigurationFile(opts)
 	if err != nil {
-		log.Error(err)
+		logErrors(err)
+		return err
 	}
 
-	// Validate discovered components
-	var validates bool
+	// Connections are reused for every operation on a host and closed
+	// once all resources have been processed
+	defer connections.closeAll()
+
+	// Validate discovered components, reporting every problem found
+	// before giving up
+	var errs errorList
 	for _, obj := range parsedFileContents {
-		validates = validateManagedResources(obj, false)
+		errs = append(errs, validateManagedResources(obj, false)...)
 		fmt.Println()
 	}
+	if len(errs) > 0 {
+		logErrors(errs)
+		return errs
+	}
 
 	// Iterate over discovered components
-	if validates {
-		var fileDiffs []FileResourceDiff
-		var packageDiffs []PackageResourceDiff
-		for _, obj := range parsedFileContents {
-			for k, v := range obj {
-				credentials := Credentials{
-					Hostname: v.Host,
-					Username: "root",
-					Password: v.Password,
-				}
-				_, err := emoji.Printf(":package: Proposed configuration for %s\n", k)
+	var fileDiffs []FileResourceDiff
+	var packageDiffs []PackageResourceDiff
+	for _, obj := range parsedFileContents {
+		for k, v := range obj {
+			credentials, err := newCredentials(v)
+			if err != nil {
+				log.Errorf("Error connecting to %s: %s", k, err)
+				continue
+			}
+			credentials.Stream = opts.Stream
+			transport, err := newTransport(credentials)
+			if err != nil {
+				log.Errorf("Error connecting to %s: %s", k, err)
+				continue
+			}
+			_, err = emoji.Printf(":package: Proposed configuration for %s\n", k)
+			if err != nil {
+				log.Fatal(err)
+			}
+			// Proposed Changes
+			showProposedOutput(v)
+			// If the resource exists in state, we must compare it
+			// Otherwise, it doesn't exist and should be created
+			fromState := ReadOneFromState(opts.stateFile(), k)
+			var resourceExistsInState bool
+			if fromState[k].Host == v.Host {
+				resourceExistsInState = true
+			} else {
+				resourceExistsInState = false
+			}
+			if resourceExistsInState {
+				// Files
+				fileDiffs = GetFileDiffs(transport, v.Files, fromState[k])
+				fmt.Println()
+				// Packages
+				packageDiffs, err = GetPackageDiffs(transport, v.Packages, fromState[k])
 				if err != nil {
-					log.Fatal(err)
+					log.Errorf("Error checking packages on %s: %s", k, err)
 				}
-				// Proposed Changes
-				showProposedOutput(v)
-				// If the resource exists in state, we must compare it
-				// Otherwise, it doesn't exist and should be created
-				fromState := ReadOneFromState(k)
-				var resourceExistsInState bool
-				if fromState[k].Host == v.Host {
-					resourceExistsInState = true
-				} else {
-					resourceExistsInState = false
-				}
-				if resourceExistsInState {
-					// Files
-					fileDiffs = GetFileDiffs(credentials, v.Files, fromState[k])
-					fmt.Println()
-					// Packages
-					packageDiffs = GetPackageDiffs(credentials, v.Packages, fromState[k])
-				} else {
-					// Files
-					fileDiffs = GetFileDiffs(credentials, v.Files, ManagedResource{})
-					fmt.Println()
-					// Packages
-					packageDiffs = GetPackageDiffs(credentials, v.Packages, ManagedResource{})
-				}
-				fmt.Println("----------------------------------------")
+			} else {
+				// Files
+				fileDiffs = GetFileDiffs(transport, v.Files, ManagedResource{})
 				fmt.Println()
-				time.Sleep(2 * time.Second)
+				// Packages
+				packageDiffs, err = GetPackageDiffs(transport, v.Packages, ManagedResource{})
+				if err != nil {
+					log.Errorf("Error checking packages on %s: %s", k, err)
+				}
 			}
+			fmt.Println("----------------------------------------")
+			fmt.Println()
+			time.Sleep(2 * time.Second)
 		}
-		if len(fileDiffs) == 0 && len(packageDiffs) == 0 {
-			color.Green("No changes to apply, resource is up to date")
-		} else {
-			color.Green("To apply these changes, run: glueprint deploy")
-		}
 	}
+	if len(fileDiffs) == 0 && len(packageDiffs) == 0 {
+		color.Green("No changes to apply, resource is up to date")
+	} else {
+		color.Green("To apply these changes, run: glueprint deploy")
+	}
+	return nil
 }
 
 // showProposedOutput displays proposed changes
@@ -86,8 +107,14 @@ func showProposedOutput(resource ManagedResource) {
 	}
 	if len(resource.Files) >= 1 {
 		for _, v := range resource.Files {
-			fmt.Printf("	Filename: %s\n", v.Name)
-			fmt.Printf("	Path: %s\n", v.Path)
+			if v.Secret != "" {
+				fmt.Printf("	Secret: %s\n", v.Secret)
+			} else if v.Content != nil {
+				fmt.Printf("	Content: %d bytes inline\n", len(*v.Content))
+			} else {
+				fmt.Printf("	Source: %s\n", v.source())
+			}
+			fmt.Printf("	Destination: %s\n", v.destination())
 			fmt.Printf("	Mode: %v\n", v.Mode)
 		}
 	} else {
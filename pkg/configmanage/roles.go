@@ -0,0 +1,99 @@
+package configmanage
+
+import (
+	"fmt"
+	"sort"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Top level keys in a configuration file declaring roles and the hosts
+// they apply to, which can't be used as resource names
+var rolesKey string = "roles"
+var groupsKey string = "groups"
+var hostsKey string = "hosts"
+
+// expandRoles returns a resource for every host in groups and hosts,
+// named group/host for hosts in a group, with their roles applied
+func expandRoles(roles map[string]RoleSpecification, groups map[string]GroupSpecification, hosts map[string]HostSpecification) (map[string]ManagedResource, error) {
+	resources := map[string]ManagedResource{}
+	for name, host := range hosts {
+		resource, err := applyRoles(host.ManagedResource, host.Roles, roles)
+		if err != nil {
+			return nil, fmt.Errorf("host %s: %s", name, err)
+		}
+		resources[name] = resource
+	}
+	for name, group := range groups {
+		if group.Host != "" {
+			return nil, fmt.Errorf("group %s: host is set, list the group's hosts under hosts instead", name)
+		}
+		if len(group.Hosts) == 0 {
+			log.Warnf("Group %s has no hosts", name)
+		}
+		for _, h := range group.Hosts {
+			member := group.ManagedResource
+			member.Host = h
+			resource, err := applyRoles(member, group.Roles, roles)
+			if err != nil {
+				return nil, fmt.Errorf("group %s: %s", name, err)
+			}
+			resourceName := fmt.Sprintf("%s/%s", name, h)
+			if _, ok := resources[resourceName]; ok {
+				return nil, fmt.Errorf("group %s: host %s is listed more than once", name, h)
+			}
+			resources[resourceName] = resource
+		}
+	}
+	return resources, nil
+}
+
+// applyRoles adds the files, packages and command of each role, in
+// order, ahead of those declared on the resource itself. Variables set
+// on the resource take precedence over those set by its roles
+func applyRoles(resource ManagedResource, roleNames []string, roles map[string]RoleSpecification) (ManagedResource, error) {
+	var files []FileSpecification
+	var packages []PackageSpecification
+	var command []string
+	var vars map[string]interface{}
+	for _, roleName := range roleNames {
+		role, ok := roles[roleName]
+		if !ok {
+			return ManagedResource{}, fmt.Errorf("role %s is not defined, defined roles are %v", roleName, definedRoles(roles))
+		}
+		files = append(files, role.Files...)
+		packages = append(packages, role.Packages...)
+		command = joinCommands(command, role.Command)
+		vars = mergeVars(vars, role.Vars)
+	}
+	// Copy so that hosts sharing a group don't share slices
+	resource.Files = append(files, resource.Files...)
+	resource.Packages = append(packages, resource.Packages...)
+	resource.Command = joinCommands(command, resource.Command)
+	resource.Vars = mergeVars(vars, resource.Vars)
+	return resource, nil
+}
+
+// joinCommands chains two commands so that the second only runs if the
+// first succeeds
+func joinCommands(first []string, second []string) []string {
+	if len(first) == 0 {
+		return second
+	}
+	if len(second) == 0 {
+		return first
+	}
+	joined := append([]string{}, first...)
+	joined = append(joined, "&&")
+	return append(joined, second...)
+}
+
+// definedRoles returns the names of the defined roles in order
+func definedRoles(roles map[string]RoleSpecification) []string {
+	names := []string{}
+	for name := range roles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,140 @@
+package configmanage
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestExpandRoles(t *testing.T) {
+	config := `roles:
+  base:
+    packages:
+      - package: curl
+    vars:
+      listen_port: 80
+  webserver:
+    files:
+      - name: index.php
+        path: /var/www/html
+    packages:
+      - package: apache2
+    command: ['service', 'apache2', 'restart']
+groups:
+  web:
+    user: deploy
+    become: true
+    hosts: [10.0.0.1, 10.0.0.2]
+    roles: [base, webserver]
+    vars:
+      listen_port: 8080
+hosts:
+  db:
+    host: 10.0.1.1
+    roles: [base]
+    packages:
+      - package: postgresql
+    command: ['service', 'postgresql', 'reload']
+`
+	resources, _, err := decodeConfiguration([]configurationSource{{path: watchedFileName, data: []byte(config)}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var names []string
+	for name := range resources {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	if want := []string{"db", "web/10.0.0.1", "web/10.0.0.2"}; !reflect.DeepEqual(names, want) {
+		t.Fatalf("decodeConfiguration() resources = %v, want %v", names, want)
+	}
+
+	web := resources["web/10.0.0.2"]
+	if web.Host != "10.0.0.2" || web.User != "deploy" || !web.Become {
+		t.Errorf("group host = %s@%s become %v, want group connection settings", web.User, web.Host, web.Become)
+	}
+	if want := []PackageSpecification{{Package: "curl"}, {Package: "apache2"}}; !reflect.DeepEqual(web.Packages, want) {
+		t.Errorf("group host packages = %v, want %v", web.Packages, want)
+	}
+	if want := []FileSpecification{{Name: "index.php", Path: "/var/www/html"}}; !reflect.DeepEqual(web.Files, want) {
+		t.Errorf("group host files = %v, want %v", web.Files, want)
+	}
+	if web.Vars["listen_port"] != 8080 {
+		t.Errorf("group host listen_port = %v, want the group's 8080 over the role's 80", web.Vars["listen_port"])
+	}
+
+	db := resources["db"]
+	if want := []PackageSpecification{{Package: "curl"}, {Package: "postgresql"}}; !reflect.DeepEqual(db.Packages, want) {
+		t.Errorf("host packages = %v, want %v", db.Packages, want)
+	}
+	if want := []string{"service", "postgresql", "reload"}; !reflect.DeepEqual(db.Command, want) {
+		t.Errorf("host command = %v, want %v", db.Command, want)
+	}
+	if db.Vars["listen_port"] != 80 {
+		t.Errorf("host listen_port = %v, want the role's 80", db.Vars["listen_port"])
+	}
+}
+
+func TestExpandRolesErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  string
+		wantErr string
+	}{
+		{
+			name:    "An undefined role should be an error",
+			config:  "hosts:\n  db:\n    host: 10.0.1.1\n    roles: [database]\n",
+			wantErr: "role database is not defined",
+		},
+		{
+			name:    "A group with a single host set should be an error",
+			config:  "groups:\n  web:\n    host: 10.0.0.1\n",
+			wantErr: "list the group's hosts under hosts instead",
+		},
+		{
+			name:    "A host listed twice in a group should be an error",
+			config:  "groups:\n  web:\n    hosts: [10.0.0.1, 10.0.0.1]\n",
+			wantErr: "listed more than once",
+		},
+		{
+			name:    "A host with the same name as a resource should be an error",
+			config:  "db:\n  host: 10.0.1.1\nhosts:\n  db:\n    host: 10.0.1.2\n",
+			wantErr: "resource db is declared more than once",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, err := decodeConfiguration([]configurationSource{{path: watchedFileName, data: []byte(tt.config)}}, nil)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("decodeConfiguration() error = %v, want error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestJoinCommands(t *testing.T) {
+	tests := []struct {
+		name   string
+		first  []string
+		second []string
+		want   []string
+	}{
+		{name: "No commands should join to none", want: nil},
+		{name: "A single command should be unchanged", second: []string{"true"}, want: []string{"true"}},
+		{
+			name:   "Two commands should be chained",
+			first:  []string{"service", "apache2", "restart"},
+			second: []string{"service", "php-fpm", "restart"},
+			want:   []string{"service", "apache2", "restart", "&&", "service", "php-fpm", "restart"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := joinCommands(tt.first, tt.second); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("joinCommands() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
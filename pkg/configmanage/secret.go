@@ -0,0 +1,97 @@
+package configmanage
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/echoboomer/glueprint/pkg/common"
+	"gopkg.in/yaml.v3"
+)
+
+// Secret is a sensitive value in the configuration file, either given
+// inline or as a reference resolved at runtime:
+//
+//	password: {env: GLUE_WEB_PW}
+//	password: {file: ~/.secrets/web}
+//	password: {command: "pass show web"}
+//	password: {secret: web_password}
+//
+// Only references are ever written to state - resolved and inline values
+// are not
+type Secret struct {
+	Value   string `yaml:"-" json:"-"`
+	Env     string `yaml:"env,omitempty" json:"env,omitempty"`
+	File    string `yaml:"file,omitempty" json:"file,omitempty"`
+	Command string `yaml:"command,omitempty" json:"command,omitempty"`
+	// Name refers to an entry in the encrypted secrets file
+	Name string `yaml:"secret,omitempty" json:"secret,omitempty"`
+}
+
+// UnmarshalYAML accepts either a plain string or a reference
+func (s *Secret) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		s.Value = value.Value
+		return nil
+	}
+	type reference Secret
+	return strictDecode(value, (*reference)(s))
+}
+
+// UnmarshalJSON discards inline values written to state by earlier
+// versions, which stored passwords as plain strings
+func (s *Secret) UnmarshalJSON(data []byte) error {
+	if len(data) > 0 && data[0] == '"' {
+		return nil
+	}
+	type reference Secret
+	return json.Unmarshal(data, (*reference)(s))
+}
+
+// String keeps secrets out of logs and output
+func (s Secret) String() string {
+	if s.IsZero() {
+		return ""
+	}
+	return "[redacted]"
+}
+
+// IsZero reports whether no secret was provided
+func (s Secret) IsZero() bool {
+	return s == Secret{}
+}
+
+// Resolve returns the value of the secret, looking references to the
+// secrets file up in secrets
+func (s Secret) Resolve(secrets secretStore) (string, error) {
+	switch {
+	case s.Value != "":
+		return s.Value, nil
+	case s.Env != "":
+		value, ok := os.LookupEnv(s.Env)
+		if !ok {
+			return "", fmt.Errorf("secret environment variable %s is not set", s.Env)
+		}
+		return value, nil
+	case s.File != "":
+		data, err := os.ReadFile(common.ExpandHomeDir(s.File))
+		if err != nil {
+			return "", fmt.Errorf("error reading secret file: %s", err)
+		}
+		return strings.TrimRight(string(data), "\r\n"), nil
+	case s.Command != "":
+		var errb strings.Builder
+		cmd := exec.Command("sh", "-c", s.Command)
+		cmd.Stderr = &errb
+		out, err := cmd.Output()
+		if err != nil {
+			return "", fmt.Errorf("error running secret command %q: %s %s", s.Command, err, strings.TrimSpace(errb.String()))
+		}
+		return strings.TrimRight(string(out), "\r\n"), nil
+	case s.Name != "":
+		return lookupSecret(secrets, s.Name)
+	}
+	return "", nil
+}
@@ -0,0 +1,96 @@
+package configmanage
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+func TestSecretResolve(t *testing.T) {
+	t.Setenv("GLUE_TEST_PW", "from-env")
+	secretFile := filepath.Join(t.TempDir(), "web")
+	if err := os.WriteFile(secretFile, []byte("from-file\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		config  string
+		want    string
+		wantErr bool
+	}{
+		{
+			name:   "An inline secret should resolve to its value",
+			config: "password: foo",
+			want:   "foo",
+		},
+		{
+			name:   "An env secret should resolve from the environment",
+			config: "password: {env: GLUE_TEST_PW}",
+			want:   "from-env",
+		},
+		{
+			name:    "An env secret should fail if the variable is not set",
+			config:  "password: {env: GLUE_TEST_UNSET}",
+			wantErr: true,
+		},
+		{
+			name:   "A file secret should resolve to the file contents without the trailing newline",
+			config: "password: {file: " + secretFile + "}",
+			want:   "from-file",
+		},
+		{
+			name:   "A command secret should resolve to the command output",
+			config: `password: {command: "echo from-command"}`,
+			want:   "from-command",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var resource ManagedResource
+			if err := yaml.Unmarshal([]byte(tt.config), &resource); err != nil {
+				t.Fatal(err)
+			}
+			got, err := resource.Password.Resolve(nil)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Secret.Resolve() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("Secret.Resolve() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSecretNotWrittenToState(t *testing.T) {
+	tests := []struct {
+		name   string
+		secret Secret
+		want   string
+	}{
+		{
+			name:   "An inline secret should not be written to state",
+			secret: Secret{Value: "foo"},
+			want:   `{}`,
+		},
+		{
+			name:   "A secret reference should be written to state",
+			secret: Secret{Env: "GLUE_WEB_PW"},
+			want:   `{"env":"GLUE_WEB_PW"}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := json.Marshal(tt.secret)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("json.Marshal(Secret) = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,300 @@
+package configmanage
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/echoboomer/glueprint/pkg/common"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/scrypt"
+	"gopkg.in/yaml.v3"
+)
+
+// The encrypted companion to the configuration file holding secrets that
+// can be referenced from it
+var secretsFileName string = "glue.secrets.enc"
+
+// Environment variables providing the key used to encrypt and decrypt the
+// secrets file - a key file takes precedence over a passphrase
+var secretsKeyFileEnv string = "GLUEPRINT_SECRETS_KEY_FILE"
+var secretsPassphraseEnv string = "GLUEPRINT_SECRETS_PASSPHRASE"
+
+// Header identifying the format of the secrets file
+const secretsFileHeader string = "glueprint-secrets:v1"
+
+// Key derivation methods recorded in the secrets file header
+const (
+	secretsMethodKey        string = "key"
+	secretsMethodPassphrase string = "scrypt"
+)
+
+// secretStore holds the decrypted contents of the secrets file kept in
+// one configuration directory
+type secretStore map[string]string
+
+// SecretsFilePath returns the path of the secrets file kept in a working
+// directory
+func SecretsFilePath(workDir string) string {
+	return filepath.Join(workDir, secretsFileName)
+}
+
+// loadSecretsFile decrypts the secrets file in dir, if there is one, so
+// that its entries can be referenced from the configuration file in the
+// same directory
+func loadSecretsFile(dir string) (secretStore, error) {
+	path := filepath.Join(dir, secretsFileName)
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return nil, nil
+	}
+	plaintext, err := decryptSecretsFile(path)
+	if err != nil {
+		return nil, err
+	}
+	secrets, err := parseSecrets(plaintext)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing secrets file %s: %s", path, err)
+	}
+	return secrets, nil
+}
+
+// lookupSecret returns an entry from a secrets file
+func lookupSecret(secrets secretStore, name string) (string, error) {
+	value, ok := secrets[name]
+	if !ok {
+		return "", fmt.Errorf("secret %s not found in %s", name, secretsFileName)
+	}
+	return value, nil
+}
+
+// parseSecrets reads the plaintext form of the secrets file, a map of
+// secret names to values in which each name is declared once
+func parseSecrets(plaintext []byte) (secretStore, error) {
+	var document yaml.Node
+	err := yaml.Unmarshal(plaintext, &document)
+	if err != nil {
+		return nil, err
+	}
+	secrets := secretStore{}
+	if len(document.Content) == 0 {
+		return secrets, nil
+	}
+	root := document.Content[0]
+	if root.Kind != yaml.MappingNode {
+		return nil, fmt.Errorf("line %d: secrets must be a map of names to values", root.Line)
+	}
+	declared := map[string]int{}
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		key := root.Content[i]
+		if line, ok := declared[key.Value]; ok {
+			return nil, fmt.Errorf("line %d: secret %s is already declared at line %d", key.Line, key.Value, line)
+		}
+		declared[key.Value] = key.Line
+	}
+	err = root.Decode(&secrets)
+	if err != nil {
+		return nil, err
+	}
+	return secrets, nil
+}
+
+// GenerateSecretsKey returns a new random key suitable for use as the
+// contents of a secrets key file
+func GenerateSecretsKey() (string, error) {
+	key := make([]byte, chacha20poly1305.KeySize)
+	if _, err := rand.Read(key); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(key), nil
+}
+
+// EncryptSecretsFile encrypts the plaintext secrets in plainPath and
+// writes them to encPath
+func EncryptSecretsFile(plainPath string, encPath string) error {
+	plaintext, err := os.ReadFile(plainPath)
+	if err != nil {
+		return err
+	}
+	if _, err := parseSecrets(plaintext); err != nil {
+		return fmt.Errorf("error parsing %s: %s", plainPath, err)
+	}
+	return encryptSecretsFile(plaintext, encPath)
+}
+
+// DecryptSecretsFile decrypts the secrets file at encPath and writes the
+// plaintext to w
+func DecryptSecretsFile(encPath string, w io.Writer) error {
+	plaintext, err := decryptSecretsFile(encPath)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(plaintext)
+	return err
+}
+
+// EditSecretsFile decrypts the secrets file at encPath into a private
+// temporary file, opens it in $EDITOR and encrypts the result - a new
+// secrets file is created if one does not exist
+func EditSecretsFile(encPath string) error {
+	var plaintext []byte
+	if _, err := os.Stat(encPath); err == nil {
+		plaintext, err = decryptSecretsFile(encPath)
+		if err != nil {
+			return err
+		}
+	}
+
+	tmpFile, err := os.CreateTemp("", "glueprint-secrets-*.yaml")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile.Name())
+	_, err = tmpFile.Write(plaintext)
+	tmpFile.Close()
+	if err != nil {
+		return err
+	}
+
+	editor := os.Getenv("EDITOR")
+	if editor == "" {
+		editor = "vi"
+	}
+	cmd := exec.Command("sh", "-c", fmt.Sprintf("%s %s", editor, shellQuote(tmpFile.Name())))
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("error running editor: %s", err)
+	}
+
+	edited, err := os.ReadFile(tmpFile.Name())
+	if err != nil {
+		return err
+	}
+	if bytes.Equal(edited, plaintext) {
+		log.Info("No changes made to secrets file")
+		return nil
+	}
+	if _, err := parseSecrets(edited); err != nil {
+		return fmt.Errorf("error parsing edited secrets, no changes were saved: %s", err)
+	}
+	return encryptSecretsFile(edited, encPath)
+}
+
+// encryptSecretsFile seals plaintext with XChaCha20-Poly1305 and writes
+// it to path, recording how the key was derived in the header
+func encryptSecretsFile(plaintext []byte, path string) error {
+	method, salt, key, err := newSecretsKey()
+	if err != nil {
+		return err
+	}
+	aead, err := chacha20poly1305.NewX(key)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	sealed := aead.Seal(nonce, nonce, plaintext, []byte(secretsFileHeader))
+
+	header := strings.Join([]string{secretsFileHeader, method, base64.StdEncoding.EncodeToString(salt)}, ":")
+	body := base64.StdEncoding.EncodeToString(sealed)
+	var out strings.Builder
+	out.WriteString(header + "\n")
+	for len(body) > 64 {
+		out.WriteString(body[:64] + "\n")
+		body = body[64:]
+	}
+	out.WriteString(body + "\n")
+
+	return os.WriteFile(path, []byte(out.String()), 0600)
+}
+
+// decryptSecretsFile opens the secrets file at path
+func decryptSecretsFile(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	lines := strings.SplitN(string(data), "\n", 2)
+	header := strings.Split(lines[0], ":")
+	if len(lines) != 2 || len(header) != 4 || strings.Join(header[:2], ":") != secretsFileHeader {
+		return nil, fmt.Errorf("%s is not a glueprint secrets file", path)
+	}
+	salt, err := base64.StdEncoding.DecodeString(header[3])
+	if err != nil {
+		return nil, fmt.Errorf("error reading secrets file %s: %s", path, err)
+	}
+	sealed, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(lines[1]), ""))
+	if err != nil {
+		return nil, fmt.Errorf("error reading secrets file %s: %s", path, err)
+	}
+
+	key, err := secretsKey(header[2], salt)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := chacha20poly1305.NewX(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return nil, fmt.Errorf("secrets file %s is truncated", path)
+	}
+	plaintext, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], []byte(secretsFileHeader))
+	if err != nil {
+		return nil, fmt.Errorf("error decrypting secrets file %s: wrong key or passphrase", path)
+	}
+	return plaintext, nil
+}
+
+// newSecretsKey returns the key used to encrypt a secrets file from the
+// configured key file or passphrase
+func newSecretsKey() (string, []byte, []byte, error) {
+	if os.Getenv(secretsKeyFileEnv) != "" {
+		key, err := secretsKey(secretsMethodKey, nil)
+		return secretsMethodKey, nil, key, err
+	}
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return "", nil, nil, err
+	}
+	key, err := secretsKey(secretsMethodPassphrase, salt)
+	return secretsMethodPassphrase, salt, key, err
+}
+
+// secretsKey loads the key for a secrets file encrypted with method
+func secretsKey(method string, salt []byte) ([]byte, error) {
+	switch method {
+	case secretsMethodKey:
+		keyFile := os.Getenv(secretsKeyFileEnv)
+		if keyFile == "" {
+			return nil, fmt.Errorf("secrets file is encrypted with a key file but %s is not set", secretsKeyFileEnv)
+		}
+		data, err := os.ReadFile(common.ExpandHomeDir(keyFile))
+		if err != nil {
+			return nil, fmt.Errorf("error reading secrets key file: %s", err)
+		}
+		key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+		if err != nil || len(key) != chacha20poly1305.KeySize {
+			return nil, fmt.Errorf("secrets key file %s does not contain a valid key", keyFile)
+		}
+		return key, nil
+	case secretsMethodPassphrase:
+		passphrase := os.Getenv(secretsPassphraseEnv)
+		if passphrase == "" {
+			return nil, fmt.Errorf("secrets file is encrypted with a passphrase but %s is not set", secretsPassphraseEnv)
+		}
+		return scrypt.Key([]byte(passphrase), salt, 1<<15, 8, 1, chacha20poly1305.KeySize)
+	default:
+		return nil, fmt.Errorf("unknown secrets file encryption method %s", method)
+	}
+}
@@ -2,63 +2,55 @@ package configmanage
 
 import (
 	"io"
-	"os"
-	"strings"
+	"io/fs"
 
-	"github.com/fatih/color"
 	log "github.com/sirupsen/logrus"
-	"golang.org/x/crypto/ssh"
-
-	"github.com/pkg/sftp"
 )
 
-// UploadFileViaSFTP leverages sftp to place a file onto a host
-func UploadFileViaSFTP(credentials Credentials, file FileSpecification) error {
-	config := &ssh.ClientConfig{
-		User: credentials.Username,
-		Auth: []ssh.AuthMethod{
-			ssh.Password(credentials.Password),
-		},
-		// This is never acceptable in production, but is suitable for a demo
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
-	}
-
-	hostAddress := strings.Join([]string{credentials.Hostname, sshPort}, ":")
-	client, err := ssh.Dial("tcp", hostAddress, config)
+// PutFile leverages sftp to place a file onto a host
+func (t *sshTransport) PutFile(path string, content io.Reader) (int64, error) {
+	// SFTP client shared with all other transfers to this host
+	sftpClient, err := connections.sftpClient(t.credentials)
 	if err != nil {
 		log.Errorf("Error executing command on host: %s", err)
-		return err
+		return 0, err
 	}
-	defer client.Close()
 
-	// Instantiate SFTP Client
-	sftpClient, err := sftp.NewClient(client)
+	// Create destination file
+	dstFile, err := sftpClient.Create(path)
 	if err != nil {
-		log.Fatal(err)
+		return 0, err
 	}
-	defer sftpClient.Close()
+	defer dstFile.Close()
 
-	fileName := strings.Join([]string{file.Path, file.Name}, "/")
+	// Copy source to destination
+	return io.Copy(dstFile, content)
+}
 
-	// Create destination file
-	dstFile, err := sftpClient.Create(fileName)
+// GetFile leverages sftp to read a file from a host
+func (t *sshTransport) GetFile(path string) ([]byte, error) {
+	sftpClient, err := connections.sftpClient(t.credentials)
 	if err != nil {
-		log.Fatal(err)
+		log.Errorf("Error executing command on host: %s", err)
+		return nil, err
 	}
-	defer dstFile.Close()
 
-	// Parse source file
-	srcFile, err := os.Open(file.Name)
+	srcFile, err := sftpClient.Open(path)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
+	defer srcFile.Close()
 
-	// Copy source to destination
-	bytes, err := io.Copy(dstFile, srcFile)
+	return io.ReadAll(srcFile)
+}
+
+// Stat leverages sftp to describe a file on a host
+func (t *sshTransport) Stat(path string) (fs.FileInfo, error) {
+	sftpClient, err := connections.sftpClient(t.credentials)
 	if err != nil {
-		log.Fatal(err)
+		log.Errorf("Error executing command on host: %s", err)
+		return nil, err
 	}
-	color.Green("%d bytes copied to %s on host", bytes, strings.Join([]string{file.Path, file.Name}, "/"))
 
-	return nil
+	return sftpClient.Stat(path)
 }
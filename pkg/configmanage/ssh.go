@@ -0,0 +1,96 @@
+package configmanage
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+)
+
+// sshTransport performs work on a managed resource over ssh and sftp
+// using the connection shared by the current run
+type sshTransport struct {
+	credentials Credentials
+}
+
+// Run executes a command on the host via an ssh session
+func (t *sshTransport) Run(command string, stdin io.Reader) (CommandResult, error) {
+	return runOnRemoteHost(t.credentials, command, stdin)
+}
+
+// RunOnRemoteHost allows execution of a command on a host via an ssh
+// shell - useful for managing resources on remote hosts
+func RunOnRemoteHost(credentials Credentials, command string) (CommandResult, error) {
+	return runOnRemoteHost(credentials, command, nil)
+}
+
+// runOnRemoteHost executes a command on a host, feeding it the supplied
+// input on stdin - output is returned even when the command exits with
+// a non-zero status
+func runOnRemoteHost(credentials Credentials, command string, stdin io.Reader) (CommandResult, error) {
+	client, err := connections.client(credentials)
+	if err != nil {
+		log.Errorf("Error executing command on host: %s", err)
+		return CommandResult{}, err
+	}
+
+	session, err := client.NewSession()
+	if err != nil {
+		// The shared connection may have dropped since it was last used
+		connections.reset(credentials)
+		client, err = connections.client(credentials)
+		if err != nil {
+			log.Errorf("Error executing command on host: %s", err)
+			return CommandResult{}, err
+		}
+		session, err = client.NewSession()
+		if err != nil {
+			log.Errorf("Error executing command on host: %s", err)
+			return CommandResult{}, err
+		}
+	}
+	defer session.Close()
+
+	output := newCommandOutput(credentials, os.Stdout)
+	session.Stdin = stdin
+	session.Stdout = output.Stdout()
+	session.Stderr = output.Stderr()
+	start := time.Now()
+	err = runWithTimeout(session, command, credentials.CommandTimeout)
+	exitStatus := 0
+	var exitErr *ssh.ExitError
+	if errors.As(err, &exitErr) {
+		exitStatus = exitErr.ExitStatus()
+	} else if err != nil {
+		log.Errorf("Error executing command on host: %s", err)
+		exitStatus = -1
+	}
+	return output.Result(exitStatus, time.Since(start)), err
+}
+
+// runWithTimeout runs a command in a session, killing it if it has not
+// finished within timeout - a timeout of zero waits indefinitely
+func runWithTimeout(session *ssh.Session, command string, timeout time.Duration) error {
+	if timeout <= 0 {
+		return session.Run(command)
+	}
+	if err := session.Start(command); err != nil {
+		return err
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- session.Wait()
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(timeout):
+		_ = session.Signal(ssh.SIGKILL)
+		session.Close()
+		return fmt.Errorf("command timed out after %s", timeout)
+	}
+}
@@ -1,21 +1,24 @@
 package configmanage
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"os"
-	"reflect"
+	"sort"
+	"strings"
 
 	log "github.com/sirupsen/logrus"
 )
 
-// The name of the state file managed by the application
-var stateFilePath string = "glueprint-state.json"
+// The name of the state file managed by the application, kept in the
+// working directory unless another path is given
+var stateFileName string = "glueprint-state.json"
 
 // CreateStateFileIfNotExists populates an empty state file when one
 // does not exist
-func CreateStateFileIfNotExists() {
+func CreateStateFileIfNotExists(stateFilePath string) {
 	emptyFile, _ := json.MarshalIndent(map[string]string{}, "", " ")
 	if _, err := os.Stat(stateFilePath); os.IsNotExist(err) {
 		err = ioutil.WriteFile(stateFilePath, emptyFile, 0600)
@@ -25,52 +28,31 @@ func CreateStateFileIfNotExists() {
 	}
 }
 
-// DeleteFromState removes a resource from the state file
-func DeleteFromState(data map[string]ManagedResource) ([]map[string]ManagedResource, error) {
+// DeleteFromState removes resources from the state file by name
+func DeleteFromState(stateFilePath string, data map[string]ManagedResource) ([]map[string]ManagedResource, error) {
 	// Read state
-	existingState := ReadFromState()
-
-	// Determine if the ManagedResource exists already
-	// Reference for the struct containing a resource's specification
-	var resource string
-	for r := range data {
-		resource = r
-	}
-
-	// Determine if the resource exists in state
-	var inState bool = false
-	for _, stateResource := range existingState {
-		_, inState = stateResource[resource]
-	}
-
-	// Remove if it does, warn if it doesn't
-	if inState {
-		// Remove
-		var newState []map[string]ManagedResource
-		for i, entry := range existingState {
-			for name := range entry {
-				if name == resource {
-					newState = append(existingState[0:i], existingState[i+1:]...)
-				}
-			}
-		}
-		updatedState, err := json.Marshal(newState)
-		if err != nil {
-			log.Errorf("Error formatting state data: %s", err)
-		}
-		err = ioutil.WriteFile(stateFilePath, updatedState, 0600)
-		if err != nil {
-			log.Errorf("Error writing to state file: %s", err)
+	existingState := ReadFromState(stateFilePath)
+
+	// Remove each resource if it exists, warn if it doesn't
+	var missing []string
+	for resource := range data {
+		var found bool
+		existingState, found = removeFromState(existingState, resource)
+		if !found {
+			log.Warnf("Resource %s not found in state file", resource)
+			missing = append(missing, resource)
 		}
-		return newState, nil
-	} else {
-		log.Warnf("Resource %s not found in state file", resource)
-		return nil, fmt.Errorf("resource %s not found in state file", resource)
 	}
+	if len(missing) == len(data) {
+		sort.Strings(missing)
+		return nil, fmt.Errorf("resource %s not found in state file", strings.Join(missing, ", "))
+	}
+	saveState(stateFilePath, existingState)
+	return existingState, nil
 }
 
 // ReadFromState parses objects stored in the state file
-func ReadFromState() []map[string]ManagedResource {
+func ReadFromState(stateFilePath string) []map[string]ManagedResource {
 	if _, err := os.Stat(stateFilePath); os.IsNotExist(err) {
 		log.Fatalf("Error reading from state file: %s", err)
 	}
@@ -94,7 +76,7 @@ func ReadFromState() []map[string]ManagedResource {
 }
 
 // ReadOneFromState parses a single object stored in the state file
-func ReadOneFromState(resource string) map[string]ManagedResource {
+func ReadOneFromState(stateFilePath string, resource string) map[string]ManagedResource {
 	if _, err := os.Stat(stateFilePath); os.IsNotExist(err) {
 		log.Warnf("Error reading from state file: %s - if this is the first time running the application, it will be created", err)
 		return map[string]ManagedResource{}
@@ -126,69 +108,101 @@ func ReadOneFromState(resource string) map[string]ManagedResource {
 	return map[string]ManagedResource{}
 }
 
-// WriteToState formats a resource to be written to state on creation,
-// update, or removal
-func WriteToState(data map[string]ManagedResource) {
-	CreateStateFileIfNotExists()
+// WriteToState formats resources to be written to state on creation or
+// update, replacing any entry already stored under the same name
+func WriteToState(stateFilePath string, data map[string]ManagedResource) {
+	CreateStateFileIfNotExists(stateFilePath)
 	// Read state
-	existingState := ReadFromState()
-
-	// Determine if the ManagedResource exists already
-	// Reference for the struct containing a resource's specification
-	var resource string
-	var resourceConfiguration ManagedResource
-	for r, c := range data {
-		resource = r
-		resourceConfiguration = c
-	}
-
-	// Determine if the resource exists in state
-	var stateResourceConfiguration ManagedResource
-	var inState bool = false
-	var ogMap map[string]ManagedResource
-
-	for _, stateResource := range existingState {
-		ogMap = stateResource
-		stateResourceConfiguration, inState = stateResource[resource]
-	}
-
-	//
-	if inState {
-		log.Infof("Resource %s found in state file", resource)
-		// Determine if requested configuration matches state configuration
-		configurationMatches := reflect.DeepEqual(resourceConfiguration, stateResourceConfiguration)
-		// Zero diff if matches, delete and re-add if not
-		if configurationMatches {
-			log.Infof("Resource %s is in sync, no changes to apply", resource)
-		} else {
-			log.Infof("Resource %s has changes, updating state file", resource)
-			// Remove
-			newState, err := DeleteFromState(ogMap)
-			if err != nil {
-				log.Errorf("Error removing resource: %s", err)
-			}
-			// Add
-			finalState := append(newState, data)
-			updatedState, err := json.Marshal(finalState)
-			if err != nil {
-				log.Errorf("Error formatting state data: %s", err)
-			}
-			err = ioutil.WriteFile(stateFilePath, updatedState, 0600)
-			if err != nil {
-				log.Errorf("Error writing to state file: %s", err)
+	existingState := ReadFromState(stateFilePath)
+
+	// Resources are written in name order so the state file is stable
+	names := make([]string, 0, len(data))
+	for resource := range data {
+		names = append(names, resource)
+	}
+	sort.Strings(names)
+
+	var changed bool
+	for _, resource := range names {
+		resourceConfiguration := data[resource]
+		stateResourceConfiguration, inState := findInState(existingState, resource)
+		if inState {
+			log.Infof("Resource %s found in state file", resource)
+			// Zero diff if matches, replace if not
+			if sameConfiguration(resourceConfiguration, stateResourceConfiguration) {
+				log.Infof("Resource %s is in sync, no changes to apply", resource)
+				continue
 			}
+			log.Infof("Resource %s has changes, updating state file", resource)
+			existingState, _ = removeFromState(existingState, resource)
+		} else {
+			log.Infof("Adding resource %s to state file...", resource)
 		}
-	} else {
-		log.Infof("Adding resource %s to state file...", resource)
-		// It doesn't exist, so create it
-		existingState = append(existingState, data)
-		updatedState, err := json.Marshal(existingState)
-		if err != nil {
-			log.Errorf("Error formatting state data: %s", err)
+		existingState = append(existingState, map[string]ManagedResource{resource: resourceConfiguration})
+		changed = true
+	}
+	if changed {
+		saveState(stateFilePath, existingState)
+	}
+}
+
+// findInState returns the entry stored in state under a resource's name
+func findInState(state []map[string]ManagedResource, resource string) (ManagedResource, bool) {
+	for _, entry := range state {
+		if stateResource, ok := entry[resource]; ok {
+			return stateResource, true
 		}
-		err = ioutil.WriteFile(stateFilePath, updatedState, 0600)
-		if err != nil {
-			log.Errorf("Error writing to state file: %s", err)
+	}
+	return ManagedResource{}, false
+}
+
+// removeFromState drops a resource from every entry in state, along with
+// any entry left empty, reporting whether it was found
+func removeFromState(state []map[string]ManagedResource, resource string) ([]map[string]ManagedResource, bool) {
+	var found bool
+	newState := make([]map[string]ManagedResource, 0, len(state))
+	for _, entry := range state {
+		if _, ok := entry[resource]; ok {
+			found = true
+			// Older state files may hold several resources in one entry
+			remaining := map[string]ManagedResource{}
+			for name, stateResource := range entry {
+				if name != resource {
+					remaining[name] = stateResource
+				}
+			}
+			entry = remaining
+		}
+		if len(entry) > 0 {
+			newState = append(newState, entry)
 		}
 	}
+	return newState, found
+}
+
+// saveState replaces the contents of the state file
+func saveState(stateFilePath string, state []map[string]ManagedResource) {
+	updatedState, err := json.Marshal(state)
+	if err != nil {
+		log.Errorf("Error formatting state data: %s", err)
+		return
+	}
+	err = ioutil.WriteFile(stateFilePath, updatedState, 0600)
+	if err != nil {
+		log.Errorf("Error writing to state file: %s", err)
+	}
+}
+
+// sameConfiguration compares resources as they are stored in state, so
+// that values never written to state such as secrets are ignored
+func sameConfiguration(a ManagedResource, b ManagedResource) bool {
+	aData, err := json.Marshal(a)
+	if err != nil {
+		return false
+	}
+	bData, err := json.Marshal(b)
+	if err != nil {
+		return false
+	}
+	return bytes.Equal(aData, bData)
 }
@@ -0,0 +1,106 @@
+package configmanage
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestWriteToState(t *testing.T) {
+	web := ManagedResource{Host: "10.0.0.1"}
+	webChanged := ManagedResource{Host: "10.0.0.1", User: "deploy"}
+	db := ManagedResource{Host: "10.0.0.2"}
+	tests := []struct {
+		name  string
+		state string
+		data  map[string]ManagedResource
+		want  []map[string]ManagedResource
+	}{
+		{
+			name: "Every resource should be added to an empty state file",
+			data: map[string]ManagedResource{"web": web, "db": db},
+			want: []map[string]ManagedResource{{"db": db}, {"web": web}},
+		},
+		{
+			name:  "A changed resource should be replaced by name",
+			state: `[{"db":{"host":"10.0.0.2"}},{"web":{"host":"10.0.0.1"}}]`,
+			data:  map[string]ManagedResource{"web": webChanged},
+			want:  []map[string]ManagedResource{{"db": db}, {"web": webChanged}},
+		},
+		{
+			name:  "A resource in sync should be left in place",
+			state: `[{"web":{"host":"10.0.0.1"}},{"db":{"host":"10.0.0.2"}}]`,
+			data:  map[string]ManagedResource{"web": web},
+			want:  []map[string]ManagedResource{{"web": web}, {"db": db}},
+		},
+		{
+			name:  "A resource should be taken out of an entry holding several",
+			state: `[{"db":{"host":"10.0.0.2"},"web":{"host":"10.0.0.1"}}]`,
+			data:  map[string]ManagedResource{"web": webChanged},
+			want:  []map[string]ManagedResource{{"db": db}, {"web": webChanged}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stateFile := filepath.Join(t.TempDir(), stateFileName)
+			if tt.state != "" {
+				writeFile(t, stateFile, tt.state)
+			}
+			WriteToState(stateFile, tt.data)
+			if got := ReadFromState(stateFile); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("WriteToState() state = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDeleteFromState(t *testing.T) {
+	web := ManagedResource{Host: "10.0.0.1"}
+	db := ManagedResource{Host: "10.0.0.2"}
+	tests := []struct {
+		name    string
+		state   string
+		data    map[string]ManagedResource
+		want    []map[string]ManagedResource
+		wantErr bool
+	}{
+		{
+			name:  "A resource should be removed by name",
+			state: `[{"web":{"host":"10.0.0.1"}},{"db":{"host":"10.0.0.2"}}]`,
+			data:  map[string]ManagedResource{"web": web},
+			want:  []map[string]ManagedResource{{"db": db}},
+		},
+		{
+			name:  "Every resource given should be removed",
+			state: `[{"web":{"host":"10.0.0.1"}},{"db":{"host":"10.0.0.2"}}]`,
+			data:  map[string]ManagedResource{"web": web, "db": db},
+			want:  []map[string]ManagedResource{},
+		},
+		{
+			name:  "Other resources in the same entry should be kept",
+			state: `[{"db":{"host":"10.0.0.2"},"web":{"host":"10.0.0.1"}}]`,
+			data:  map[string]ManagedResource{"web": web},
+			want:  []map[string]ManagedResource{{"db": db}},
+		},
+		{
+			name:    "A resource missing from state should be an error",
+			state:   `[{"db":{"host":"10.0.0.2"}}]`,
+			data:    map[string]ManagedResource{"web": web},
+			want:    []map[string]ManagedResource{{"db": db}},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stateFile := filepath.Join(t.TempDir(), stateFileName)
+			writeFile(t, stateFile, tt.state)
+			_, err := DeleteFromState(stateFile, tt.data)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("DeleteFromState() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got := ReadFromState(stateFile); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("DeleteFromState() state = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,164 @@
+package configmanage
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// configurationFile is what a configuration file is decoded into when it
+// is checked - any key that isn't reserved is a resource
+type configurationFile struct {
+	Variables yaml.Node                     `yaml:"variables"`
+	Vars      map[string]interface{}        `yaml:"vars"`
+	Roles     map[string]RoleSpecification  `yaml:"roles"`
+	Groups    map[string]GroupSpecification `yaml:"groups"`
+	Hosts     map[string]HostSpecification  `yaml:"hosts"`
+	Resources map[string]ManagedResource    `yaml:",inline"`
+}
+
+// Matches the position yaml gives for each problem decoding a value
+var yamlLinePattern = regexp.MustCompile(`^line (\d+): (.*)$`)
+
+// Matches a line yaml refers to within a problem
+var yamlReferencePattern = regexp.MustCompile(`at line (\d+)`)
+
+// Matches the key yaml names in problems with a field
+var yamlFieldPattern = regexp.MustCompile(`^(?:field (\S+) (?:not found|already set)|mapping key "(.*)" already defined)`)
+
+// checkConfiguration reports every unknown field and every value of the
+// wrong type in a configuration file, where document is its top level
+// mapping
+func checkConfiguration(document *yaml.Node) errorList {
+	if document.Kind != yaml.MappingNode {
+		return errorList{newConfigError(document, "configuration must be a map of resources")}
+	}
+	// Resources are decoded into a map inlined in a struct, which yaml
+	// doesn't check for duplicate keys, so the file is also decoded as
+	// a plain map
+	return decodeKnownFields(document, &map[string]yaml.Node{}, &configurationFile{})
+}
+
+// strictDecode decodes node into out like decodeKnownFields, for types
+// decoding themselves, where yaml expects problems to be returned as a
+// *yaml.TypeError
+func strictDecode(node *yaml.Node, out interface{}) error {
+	errs := decodeKnownFields(node, out)
+	if len(errs) == 0 {
+		return nil
+	}
+	typeErr := &yaml.TypeError{}
+	for _, err := range errs {
+		e := err.(configError)
+		typeErr.Errors = append(typeErr.Errors, fmt.Sprintf("line %d: %s", e.Line, e.Message))
+	}
+	return typeErr
+}
+
+// decodeKnownFields decodes node into each of outs in turn, reporting
+// every field with no place in them and every other problem once, at
+// the position in node it was found. Only a yaml.Decoder checks fields,
+// so node is written out and read back, and each problem traced back to
+// the node it was found at
+func decodeKnownFields(node *yaml.Node, outs ...interface{}) errorList {
+	data, err := yaml.Marshal(node)
+	if err != nil {
+		return errorList{newConfigError(node, "%s", err)}
+	}
+	var copied yaml.Node
+	err = yaml.Unmarshal(data, &copied)
+	if err != nil || len(copied.Content) == 0 {
+		return errorList{newConfigError(node, "%s", err)}
+	}
+	positions := nodePositions{}
+	positions.add(copied.Content[0], node, false)
+
+	var errs errorList
+	reported := map[*yaml.Node]bool{}
+	for _, out := range outs {
+		decoder := yaml.NewDecoder(bytes.NewReader(data))
+		decoder.KnownFields(true)
+		err := decoder.Decode(out)
+		if err == nil {
+			continue
+		}
+		typeErr, ok := err.(*yaml.TypeError)
+		if !ok {
+			return append(errs, newConfigError(node, "%s", err))
+		}
+		for _, message := range typeErr.Errors {
+			at, message := positions.find(node, message)
+			if reported[at] {
+				continue
+			}
+			reported[at] = true
+			errs = append(errs, newConfigError(at, "%s", message))
+		}
+	}
+	return errs
+}
+
+// nodePositions holds the node each node read back from a written out
+// tree came from, by the line it was read back from
+type nodePositions map[int][]positionedNode
+
+// positionedNode is a node on a line, and whether it is a mapping key
+type positionedNode struct {
+	node *yaml.Node
+	key  bool
+}
+
+// add records that copied was read back from original, along with the
+// nodes below it
+func (p nodePositions) add(copied *yaml.Node, original *yaml.Node, key bool) {
+	p[copied.Line] = append(p[copied.Line], positionedNode{node: original, key: key})
+	if len(copied.Content) != len(original.Content) {
+		return
+	}
+	for i := range copied.Content {
+		p.add(copied.Content[i], original.Content[i], original.Kind == yaml.MappingNode && i%2 == 0)
+	}
+}
+
+// find returns the node a problem yaml reported was found at, and the
+// problem without its position. Lines referred to in the problem are
+// replaced with the lines they came from
+func (p nodePositions) find(root *yaml.Node, message string) (*yaml.Node, string) {
+	parts := yamlLinePattern.FindStringSubmatch(message)
+	if parts == nil {
+		return root, message
+	}
+	line, _ := strconv.Atoi(parts[1])
+	message = yamlReferencePattern.ReplaceAllStringFunc(parts[2], func(reference string) string {
+		referenced, _ := strconv.Atoi(strings.TrimPrefix(reference, "at line "))
+		if candidates := p[referenced]; len(candidates) > 0 {
+			referenced = candidates[0].node.Line
+		}
+		return fmt.Sprintf("at line %d", referenced)
+	})
+
+	candidates := p[line]
+	if len(candidates) == 0 {
+		return root, message
+	}
+	// Problems with a field are found at its key, and problems with a
+	// value at the first value of the type yaml names on the line
+	if field := yamlFieldPattern.FindStringSubmatch(message); field != nil {
+		name := field[1] + field[2]
+		for _, c := range candidates {
+			if c.key && c.node.Value == name {
+				return c.node, message
+			}
+		}
+	}
+	for _, c := range candidates {
+		if !c.key && strings.Contains(message, "cannot unmarshal "+c.node.ShortTag()+" ") {
+			return c.node, message
+		}
+	}
+	return candidates[0].node, message
+}
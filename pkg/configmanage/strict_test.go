@@ -0,0 +1,90 @@
+package configmanage
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDecodeConfigurationStrict(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  string
+		overlay string
+		want    []string
+	}{
+		{
+			name:   "A misspelled field should be reported",
+			config: "web:\n  host: 1.2.3.4\n  pacakges:\n    - package: nginx\n",
+			want:   []string{"glue.yaml:3:3: field pacakges not found in type configmanage.ManagedResource"},
+		},
+		{
+			name: "Every problem should be reported with its position",
+			config: `web:
+  host: 1.2.3.4
+  port: twenty-two
+  files:
+    - name: index.php
+      path: /var/www/html
+      mdoe: "0644"
+  timeouts:
+    connect: soon
+db:
+  hots: 5.6.7.8
+`,
+			want: []string{
+				"glue.yaml:3:9: cannot unmarshal !!str `twenty-two` into int",
+				"glue.yaml:7:7: field mdoe not found in type configmanage.FileSpecification",
+				"glue.yaml:9:14: cannot unmarshal !!str `soon` into time.Duration",
+				"glue.yaml:11:3: field hots not found in type configmanage.ManagedResource",
+			},
+		},
+		{
+			name:   "Fields of reserved keys and references should be checked",
+			config: "roles:\n  web:\n    packages:\n      - name: nginx\nsvc:\n  host: 1.2.3.4\n  password: {enb: PW}\n",
+			want: []string{
+				"glue.yaml:4:9: field name not found in type configmanage.PackageSpecification",
+				"glue.yaml:7:14: field enb not found in type configmanage.reference",
+			},
+		},
+		{
+			name:   "A field set twice should be reported",
+			config: "web:\n  host: 1.2.3.4\n  host: 5.6.7.8\n",
+			want:   []string{`glue.yaml:3:3: mapping key "host" already defined at line 2`},
+		},
+		{
+			name:   "A resource declared twice should be reported once",
+			config: "web:\n  host: 1.2.3.4\nroles: {}\nweb:\n  host: 5.6.7.8\nroles: {}\n",
+			want: []string{
+				`glue.yaml:4:1: mapping key "web" already defined at line 1`,
+				`glue.yaml:6:1: mapping key "roles" already defined at line 3`,
+			},
+		},
+		{
+			name:   "A syntax error should be reported with its line",
+			config: "web:\n  host: 1.2.3.4\n packages: []\n",
+			want:   []string{"glue.yaml:2: did not find expected key"},
+		},
+		{
+			name:    "Problems in an overlay should be reported against the overlay",
+			config:  "web:\n  host: 1.2.3.4\n",
+			overlay: "web:\n  prot: 2222\n",
+			want:    []string{"glue.prod.yaml:2:3: field prot not found in type configmanage.ManagedResource"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sources := []configurationSource{{path: watchedFileName, data: []byte(tt.config)}}
+			if tt.overlay != "" {
+				sources = append(sources, configurationSource{path: "glue.prod.yaml", data: []byte(tt.overlay)})
+			}
+			_, _, err := decodeConfiguration(sources, nil)
+			if err == nil {
+				t.Fatalf("decodeConfiguration() error = nil, want %v", tt.want)
+			}
+			if got := strings.Split(err.Error(), "\n"); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("decodeConfiguration() error =\n%s\nwant\n%s", err, strings.Join(tt.want, "\n"))
+			}
+		})
+	}
+}
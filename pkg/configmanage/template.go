@@ -0,0 +1,344 @@
+package configmanage
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+	"text/template"
+
+	"github.com/fatih/color"
+)
+
+// templateData is what templated files are rendered with
+type templateData struct {
+	Name string
+	Host string
+	Port int
+	User string
+	Vars map[string]interface{}
+}
+
+// newTemplateData returns the data a resource's templated files are
+// rendered with
+func newTemplateData(name string, resource ManagedResource) templateData {
+	port := resource.Port
+	if port == 0 {
+		port = defaultSSHPort
+	}
+	user := resource.User
+	if user == "" {
+		user = defaultUsername
+	}
+	vars := resource.Vars
+	if vars == nil {
+		vars = map[string]interface{}{}
+	}
+	return templateData{Name: name, Host: resource.Host, Port: port, User: user, Vars: vars}
+}
+
+// renderTemplate renders the content of a templated file - referencing
+// a variable that is not set is an error rather than an empty string
+func renderTemplate(name string, content []byte, data templateData) ([]byte, error) {
+	tmpl, err := template.New(name).Funcs(templateFuncs).Option("missingkey=error").Parse(string(content))
+	if err != nil {
+		return nil, err
+	}
+	var out bytes.Buffer
+	if err := tmpl.Execute(&out, data); err != nil {
+		return nil, err
+	}
+	// A template rendering to nothing still has content, which must not
+	// fall back to the template itself
+	return append([]byte{}, out.Bytes()...), nil
+}
+
+// mergeVars returns the variables in base overridden by those in
+// override
+func mergeVars(base map[string]interface{}, override map[string]interface{}) map[string]interface{} {
+	if len(base) == 0 {
+		return override
+	}
+	merged := map[string]interface{}{}
+	for k, v := range base {
+		merged[k] = v
+	}
+	for k, v := range override {
+		merged[k] = v
+	}
+	return merged
+}
+
+// Helpers available to templates, named and ordered as in sprig so that
+// they can be piped
+var templateFuncs = template.FuncMap{
+	"default": func(def interface{}, value ...interface{}) interface{} {
+		if len(value) == 0 || isEmpty(value[0]) {
+			return def
+		}
+		return value[0]
+	},
+	"empty": isEmpty,
+	"required": func(msg string, value interface{}) (interface{}, error) {
+		if isEmpty(value) {
+			return nil, errors.New(msg)
+		}
+		return value, nil
+	},
+	"ternary": func(a interface{}, b interface{}, cond bool) interface{} {
+		if cond {
+			return a
+		}
+		return b
+	},
+	"env":        os.Getenv,
+	"upper":      strings.ToUpper,
+	"lower":      strings.ToLower,
+	"trim":       strings.TrimSpace,
+	"trimPrefix": func(prefix string, s string) string { return strings.TrimPrefix(s, prefix) },
+	"trimSuffix": func(suffix string, s string) string { return strings.TrimSuffix(s, suffix) },
+	"replace":    func(old string, new string, s string) string { return strings.ReplaceAll(s, old, new) },
+	"contains":   func(substr string, s string) bool { return strings.Contains(s, substr) },
+	"hasPrefix":  func(prefix string, s string) bool { return strings.HasPrefix(s, prefix) },
+	"hasSuffix":  func(suffix string, s string) bool { return strings.HasSuffix(s, suffix) },
+	"quote":      func(value interface{}) string { return fmt.Sprintf("%q", toString(value)) },
+	"squote":     func(value interface{}) string { return "'" + toString(value) + "'" },
+	"indent": func(spaces int, s string) string {
+		pad := strings.Repeat(" ", spaces)
+		return pad + strings.ReplaceAll(s, "\n", "\n"+pad)
+	},
+	"nindent": func(spaces int, s string) string {
+		pad := strings.Repeat(" ", spaces)
+		return "\n" + pad + strings.ReplaceAll(s, "\n", "\n"+pad)
+	},
+	"join": func(sep string, list interface{}) string {
+		var items []string
+		v := reflect.ValueOf(list)
+		if v.Kind() != reflect.Slice && v.Kind() != reflect.Array {
+			return toString(list)
+		}
+		for i := 0; i < v.Len(); i++ {
+			items = append(items, toString(v.Index(i).Interface()))
+		}
+		return strings.Join(items, sep)
+	},
+	"split": func(sep string, s string) []string { return strings.Split(s, sep) },
+	"toJson": func(value interface{}) (string, error) {
+		data, err := json.Marshal(value)
+		return string(data), err
+	},
+}
+
+// isEmpty reports whether a template value is unset or its type's zero
+// value
+func isEmpty(value interface{}) bool {
+	if value == nil {
+		return true
+	}
+	v := reflect.ValueOf(value)
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	default:
+		return v.IsZero()
+	}
+}
+
+// toString formats a template value as text
+func toString(value interface{}) string {
+	if value == nil {
+		return ""
+	}
+	return fmt.Sprint(value)
+}
+
+// The largest file, in lines, that a diff is shown for
+const maxDiffLines int = 5000
+
+// Lines shown around each change in a diff
+const diffContextLines int = 2
+
+// diffLine is a single line of a line diff - Op is one of ' ', '-' or '+'
+type diffLine struct {
+	Op   byte
+	Text string
+}
+
+// lineDiff returns the shortest set of changes between two texts line by
+// line, found with Myers' algorithm in linear space
+func lineDiff(from string, to string) []diffLine {
+	d := &differ{a: splitLines(from), b: splitLines(to)}
+	d.compare(0, len(d.a), 0, len(d.b))
+	return d.lines
+}
+
+// differ collects the lines of a diff between a and b in order
+type differ struct {
+	a     []string
+	b     []string
+	lines []diffLine
+}
+
+// compare adds the changes between a[aLo:aHi] and b[bLo:bHi], splitting
+// them at the middle of the shortest edit path until one side is empty
+func (d *differ) compare(aLo int, aHi int, bLo int, bHi int) {
+	for aLo < aHi && bLo < bHi && d.a[aLo] == d.b[bLo] {
+		d.lines = append(d.lines, diffLine{Op: ' ', Text: d.a[aLo]})
+		aLo++
+		bLo++
+	}
+	suffix := 0
+	for aLo < aHi-suffix && bLo < bHi-suffix && d.a[aHi-suffix-1] == d.b[bHi-suffix-1] {
+		suffix++
+	}
+	aHi -= suffix
+	bHi -= suffix
+
+	x, y, ok := 0, 0, false
+	if aLo < aHi && bLo < bHi {
+		x, y, ok = d.middle(aLo, aHi, bLo, bHi)
+		// A split at either end would not make the problem smaller
+		ok = ok && !(x == aLo && y == bLo) && !(x == aHi && y == bHi)
+	}
+	if ok {
+		d.compare(aLo, x, bLo, y)
+		d.compare(x, aHi, y, bHi)
+	} else {
+		for i := aLo; i < aHi; i++ {
+			d.lines = append(d.lines, diffLine{Op: '-', Text: d.a[i]})
+		}
+		for j := bLo; j < bHi; j++ {
+			d.lines = append(d.lines, diffLine{Op: '+', Text: d.b[j]})
+		}
+	}
+
+	for i := aHi; i < aHi+suffix; i++ {
+		d.lines = append(d.lines, diffLine{Op: ' ', Text: d.a[i]})
+	}
+}
+
+// middle searches for the shortest edit path between a[aLo:aHi] and
+// b[bLo:bHi] from both ends at once, and returns the point where the two
+// searches meet
+func (d *differ) middle(aLo int, aHi int, bLo int, bHi int) (int, int, bool) {
+	n, m := aHi-aLo, bHi-bLo
+	maxD := (n + m + 1) / 2
+	offset := maxD + 1
+	// forward[k] is the furthest x reached from the start on diagonal
+	// k = x - y, and backward[k] the furthest reached from the end
+	forward := make([]int, 2*offset+1)
+	backward := make([]int, 2*offset+1)
+	for i := range forward {
+		forward[i] = -1
+		backward[i] = -1
+	}
+	forward[offset+1] = 0
+	backward[offset+1] = 0
+	delta := n - m
+	// When the lengths differ by an odd number the paths meet going
+	// forward, otherwise they meet going backward
+	odd := delta%2 != 0
+
+	for step := 0; step < maxD; step++ {
+		for k := -step; k <= step; k += 2 {
+			var x int
+			if k == -step || k != step && forward[offset+k-1] < forward[offset+k+1] {
+				x = forward[offset+k+1]
+			} else {
+				x = forward[offset+k-1] + 1
+			}
+			y := x - k
+			if x < 0 || y < 0 || x > n || y > m {
+				continue
+			}
+			for x < n && y < m && d.a[aLo+x] == d.b[bLo+y] {
+				x++
+				y++
+			}
+			forward[offset+k] = x
+			if odd {
+				back := offset + delta - k
+				if back >= 0 && back < len(backward) && backward[back] != -1 && x >= n-backward[back] {
+					return aLo + x, bLo + y, true
+				}
+			}
+		}
+		for k := -step; k <= step; k += 2 {
+			var x int
+			if k == -step || k != step && backward[offset+k-1] < backward[offset+k+1] {
+				x = backward[offset+k+1]
+			} else {
+				x = backward[offset+k-1] + 1
+			}
+			y := x - k
+			if x < 0 || y < 0 || x > n || y > m {
+				continue
+			}
+			for x < n && y < m && d.a[aHi-x-1] == d.b[bHi-y-1] {
+				x++
+				y++
+			}
+			backward[offset+k] = x
+			if !odd {
+				front := offset + delta - k
+				if front >= 0 && front < len(forward) && forward[front] != -1 && forward[front] >= n-x {
+					fx := forward[front]
+					return aLo + fx, bLo + fx - (front - offset), true
+				}
+			}
+		}
+	}
+	return 0, 0, false
+}
+
+// splitLines splits text into lines, ignoring a trailing newline
+func splitLines(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(s, "\n"), "\n")
+}
+
+// printLineDiff shows the changes between the content of a file on the
+// host and the content it will be replaced with, with a few lines of
+// context around each change
+func printLineDiff(from string, to string) {
+	if len(splitLines(from)) > maxDiffLines || len(splitLines(to)) > maxDiffLines {
+		fmt.Println("    (file too large to show changes)")
+		return
+	}
+	lines := lineDiff(from, to)
+	show := make([]bool, len(lines))
+	for i, line := range lines {
+		if line.Op == ' ' {
+			continue
+		}
+		for j := i - diffContextLines; j <= i+diffContextLines; j++ {
+			if j >= 0 && j < len(lines) {
+				show[j] = true
+			}
+		}
+	}
+	skipped := false
+	for i, line := range lines {
+		if !show[i] {
+			skipped = true
+			continue
+		}
+		if skipped {
+			fmt.Println("    ...")
+			skipped = false
+		}
+		switch line.Op {
+		case '-':
+			color.Red("    - %s", line.Text)
+		case '+':
+			color.Green("    + %s", line.Text)
+		default:
+			fmt.Printf("      %s\n", line.Text)
+		}
+	}
+}
@@ -0,0 +1,219 @@
+package configmanage
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/fatih/color"
+)
+
+func TestRenderTemplate(t *testing.T) {
+	data := templateData{
+		Name: "web",
+		Host: "10.0.0.5",
+		Port: 22,
+		User: "root",
+		Vars: map[string]interface{}{
+			"listen_port": 8080,
+			"server_name": "example.com",
+			"upstreams":   []interface{}{"10.0.1.1", "10.0.1.2"},
+			"empty":       "",
+		},
+	}
+
+	tests := []struct {
+		name    string
+		content string
+		want    string
+		wantErr string
+	}{
+		{
+			name:    "Resource fields and variables should be rendered",
+			content: "listen {{ .Host }}:{{ .Vars.listen_port }};\nserver_name {{ .Vars.server_name }};",
+			want:    "listen 10.0.0.5:8080;\nserver_name example.com;",
+		},
+		{
+			name:    "Helpers should be available",
+			content: `{{ .Vars.server_name | upper }} {{ .Vars.empty | default "none" }} {{ join "," .Vars.upstreams }} {{ .Name | quote }}`,
+			want:    `EXAMPLE.COM none 10.0.1.1,10.0.1.2 "web"`,
+		},
+		{
+			name:    "Ranging over a list should render each item",
+			content: "{{ range .Vars.upstreams }}server {{ . }};\n{{ end }}",
+			want:    "server 10.0.1.1;\nserver 10.0.1.2;\n",
+		},
+		{
+			name:    "A missing variable should be an error",
+			content: "{{ .Vars.missing }}",
+			wantErr: "missing",
+		},
+		{
+			name:    "A required variable that is empty should be an error",
+			content: `{{ required "empty must be set" .Vars.empty }}`,
+			wantErr: "empty must be set",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := renderTemplate("test", []byte(tt.content), data)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("renderTemplate() error = %v, want error containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("renderTemplate() error = %s", err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("renderTemplate() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLineDiff(t *testing.T) {
+	tests := []struct {
+		name string
+		from string
+		to   string
+		want []diffLine
+	}{
+		{
+			name: "Identical texts should have no changes",
+			from: "a\nb\n",
+			to:   "a\nb\n",
+			want: []diffLine{{' ', "a"}, {' ', "b"}},
+		},
+		{
+			name: "A changed line should be removed and added",
+			from: "listen 80;\nserver_name old;\nroot /var/www;\n",
+			to:   "listen 80;\nserver_name new;\nroot /var/www;\n",
+			want: []diffLine{{' ', "listen 80;"}, {'-', "server_name old;"}, {'+', "server_name new;"}, {' ', "root /var/www;"}},
+		},
+		{
+			name: "The shortest set of changes should be found",
+			from: "a\nb\nc\na\nb\nb\na\n",
+			to:   "c\nb\na\nb\na\nc\n",
+			want: []diffLine{{'-', "a"}, {'+', "c"}, {' ', "b"}, {'-', "c"}, {' ', "a"}, {' ', "b"}, {'-', "b"}, {' ', "a"}, {'+', "c"}},
+		},
+		{
+			name: "A removed file should be all removals",
+			from: "a\nb\n",
+			to:   "",
+			want: []diffLine{{'-', "a"}, {'-', "b"}},
+		},
+		{
+			name: "A new file should be all additions",
+			from: "",
+			to:   "a\nb",
+			want: []diffLine{{'+', "a"}, {'+', "b"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := lineDiff(tt.from, tt.to); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("lineDiff() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLineDiffLargeFile(t *testing.T) {
+	lines := make([]string, maxDiffLines)
+	for i := range lines {
+		lines[i] = fmt.Sprintf("line %d", i)
+	}
+	from := strings.Join(lines, "\n")
+	lines[maxDiffLines/2] = "changed"
+	to := strings.Join(lines, "\n")
+
+	var changes []diffLine
+	for _, line := range lineDiff(from, to) {
+		if line.Op != ' ' {
+			changes = append(changes, line)
+		}
+	}
+	want := []diffLine{{'-', fmt.Sprintf("line %d", maxDiffLines/2)}, {'+', "changed"}}
+	if !reflect.DeepEqual(changes, want) {
+		t.Errorf("lineDiff() changes = %v, want %v", changes, want)
+	}
+}
+
+func TestGetFileDiffsShowsTemplates(t *testing.T) {
+	rendered := FileSpecification{Dest: "/etc/nginx/nginx.conf", Template: true, rendered: []byte("listen 8080;\nserver_name example.com;\n")}
+	renderedHash := fmt.Sprintf("%x", sha1.Sum(rendered.rendered))
+
+	tests := []struct {
+		name      string
+		results   map[string]CommandResult
+		files     map[string][]byte
+		fromState ManagedResource
+		want      []string
+	}{
+		{
+			name:      "A templated file being created should show its rendered content",
+			fromState: ManagedResource{},
+			want:      []string{"+ listen 8080;", "+ server_name example.com;"},
+		},
+		{
+			name: "A templated file being replaced should show its changes",
+			results: map[string]CommandResult{
+				"sha1sum '/etc/nginx/nginx.conf'": {Stdout: "da39a3ee5e6b4b0d3255bfef95601890afd80709  /etc/nginx/nginx.conf"},
+			},
+			files:     map[string][]byte{"/etc/nginx/nginx.conf": []byte("listen 80;\nserver_name example.com;\n")},
+			fromState: ManagedResource{Files: []FileSpecification{rendered}},
+			want:      []string{"- listen 80;", "+ listen 8080;", "  server_name example.com;"},
+		},
+		{
+			name: "An unchanged templated file should show nothing",
+			results: map[string]CommandResult{
+				"sha1sum '/etc/nginx/nginx.conf'": {Stdout: renderedHash + "  /etc/nginx/nginx.conf"},
+			},
+			files:     map[string][]byte{"/etc/nginx/nginx.conf": rendered.rendered},
+			fromState: ManagedResource{Files: []FileSpecification{rendered}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			transport := newFakeTransport(tt.results, tt.files)
+			out := captureOutput(t, func() {
+				GetFileDiffs(transport, []FileSpecification{rendered}, tt.fromState)
+			})
+			for _, line := range tt.want {
+				if !strings.Contains(out, line) {
+					t.Errorf("GetFileDiffs() output does not contain %q:\n%s", line, out)
+				}
+			}
+			if len(tt.want) == 0 && strings.Contains(out, "listen") {
+				t.Errorf("GetFileDiffs() showed content of an unchanged file:\n%s", out)
+			}
+		})
+	}
+}
+
+// captureOutput returns everything printed to stdout while f runs
+func captureOutput(t *testing.T, f func()) string {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout, colorOutput := os.Stdout, color.Output
+	os.Stdout, color.Output = w, w
+	defer func() { os.Stdout, color.Output = stdout, colorOutput }()
+
+	done := make(chan []byte)
+	go func() {
+		out, _ := io.ReadAll(r)
+		done <- out
+	}()
+	f()
+	w.Close()
+	return string(<-done)
+}
@@ -0,0 +1,379 @@
+package configmanage
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// Credentials accepted by the test ssh server
+const (
+	testServerUser     string = "root"
+	testServerPassword string = "glue"
+)
+
+// testSSHServer is an in-process ssh server backed by a temporary
+// directory. Commands run with the local shell, with fake dpkg-query and
+// apt commands first on the PATH that record installed packages in a
+// file under the root, and the sftp subsystem serves the local
+// filesystem. direct-tcpip channels are forwarded so the server can be
+// used as a bastion. Users authenticate with the password, a certificate
+// signed by UserCA or a key added with AuthorizeKey
+type testSSHServer struct {
+	Host       string
+	Port       int
+	Root       string
+	KnownHosts string
+	UserCA     ssh.Signer
+
+	listener       net.Listener
+	wg             sync.WaitGroup
+	mu             sync.Mutex
+	authorizedKeys []ssh.PublicKey
+}
+
+// Fake package management commands installed on the test server - the
+// package database holds one "package version" line per installed package
+var testServerCommands = map[string]string{
+	"dpkg-query": `#!/bin/sh
+format=""
+for arg in "$@"; do
+	case "$arg" in
+		--showformat=*) format="${arg#--showformat=}" ;;
+		--show) ;;
+		*) pkg="$arg" ;;
+	esac
+done
+version=$(awk -v p="$pkg" '$1 == p { print $2 }' "$GLUE_TEST_ROOT/packages" 2>/dev/null)
+if [ -z "$version" ]; then
+	echo "dpkg-query: no packages found matching $pkg" >&2
+	exit 1
+fi
+if [ -n "$format" ]; then
+	printf '%s' "$version"
+else
+	printf '%s\t%s\n' "$pkg" "$version"
+fi
+`,
+	"apt": `#!/bin/sh
+db="$GLUE_TEST_ROOT/packages"
+touch "$db"
+action="$1"
+shift
+case "$action" in
+	update)
+		echo "Reading package lists... Done"
+		;;
+	install|remove)
+		for arg in "$@"; do
+			[ "$arg" = "-y" ] && continue
+			pkg="${arg%%=*}"
+			version="1.0"
+			[ "$pkg" != "$arg" ] && version="${arg#*=}"
+			awk -v p="$pkg" '$1 != p' "$db" > "$db.tmp" && mv "$db.tmp" "$db"
+			if [ "$action" = "install" ]; then
+				echo "$pkg $version" >> "$db"
+				echo "Setting up $pkg ($version) ..."
+			else
+				echo "Removing $pkg ($version) ..."
+			fi
+		done
+		;;
+	*)
+		echo "E: Invalid operation $action" >&2
+		exit 100
+		;;
+esac
+`,
+}
+
+// newTestSSHServer starts a test ssh server that is stopped when the
+// test completes
+func newTestSSHServer(t *testing.T) *testSSHServer {
+	t.Helper()
+	return startTestSSHServer(t, nil)
+}
+
+// newTestSSHServerWithHostCA starts a test ssh server that presents a
+// host certificate signed by hostCA
+func newTestSSHServerWithHostCA(t *testing.T, hostCA ssh.Signer) *testSSHServer {
+	t.Helper()
+	return startTestSSHServer(t, hostCA)
+}
+
+func startTestSSHServer(t *testing.T, hostCA ssh.Signer) *testSSHServer {
+	t.Helper()
+
+	root := t.TempDir()
+	bin := filepath.Join(root, "bin")
+	if err := os.MkdirAll(bin, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for name, script := range testServerCommands {
+		if err := os.WriteFile(filepath.Join(bin, name), []byte(script), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	signer := newTestSigner(t)
+	userCA := newTestSigner(t)
+	s := &testSSHServer{Root: root, UserCA: userCA}
+	userChecker := &ssh.CertChecker{
+		IsUserAuthority: func(auth ssh.PublicKey) bool {
+			return bytes.Equal(auth.Marshal(), userCA.PublicKey().Marshal())
+		},
+		UserKeyFallback: s.checkAuthorizedKey,
+	}
+	config := &ssh.ServerConfig{
+		PasswordCallback: func(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			if conn.User() == testServerUser && string(password) == testServerPassword {
+				return nil, nil
+			}
+			return nil, errors.New("permission denied")
+		},
+		PublicKeyCallback: userChecker.Authenticate,
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().(*net.TCPAddr)
+
+	if hostCA != nil {
+		cert := &ssh.Certificate{
+			Key:             signer.PublicKey(),
+			CertType:        ssh.HostCert,
+			KeyId:           "test server",
+			ValidPrincipals: []string{addr.IP.String()},
+			ValidBefore:     ssh.CertTimeInfinity,
+		}
+		if err := cert.SignCert(rand.Reader, hostCA); err != nil {
+			t.Fatal(err)
+		}
+		certSigner, err := ssh.NewCertSigner(cert, signer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		config.AddHostKey(certSigner)
+	} else {
+		config.AddHostKey(signer)
+	}
+
+	// Trust the server's key so connections are verified as normal
+	knownHosts := filepath.Join(root, "known_hosts")
+	line := knownhosts.Line([]string{knownhosts.Normalize(addr.String())}, signer.PublicKey())
+	if err := os.WriteFile(knownHosts, []byte(line+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	s.Host = addr.IP.String()
+	s.Port = addr.Port
+	s.KnownHosts = knownHosts
+	s.listener = listener
+	s.wg.Add(1)
+	go s.serve(config)
+	t.Cleanup(func() {
+		listener.Close()
+		s.wg.Wait()
+	})
+	return s
+}
+
+// newTestSigner generates an ed25519 key for a test
+func newTestSigner(t *testing.T) ssh.Signer {
+	t.Helper()
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+// AuthorizeKey lets users authenticate with key
+func (s *testSSHServer) AuthorizeKey(key ssh.PublicKey) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.authorizedKeys = append(s.authorizedKeys, key)
+}
+
+func (s *testSSHServer) checkAuthorizedKey(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, authorized := range s.authorizedKeys {
+		if bytes.Equal(authorized.Marshal(), key.Marshal()) {
+			return nil, nil
+		}
+	}
+	return nil, errors.New("unknown public key")
+}
+
+// Packages returns the contents of the fake package database
+func (s *testSSHServer) Packages(t *testing.T) string {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join(s.Root, "packages"))
+	if err != nil && !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func (s *testSSHServer) serve(config *ssh.ServerConfig) {
+	defer s.wg.Done()
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.handleConn(conn, config)
+		}()
+	}
+}
+
+func (s *testSSHServer) handleConn(conn net.Conn, config *ssh.ServerConfig) {
+	serverConn, chans, reqs, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	defer serverConn.Close()
+	go ssh.DiscardRequests(reqs)
+
+	for newChannel := range chans {
+		if newChannel.ChannelType() == "direct-tcpip" {
+			go s.forward(newChannel)
+			continue
+		}
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "unsupported channel type")
+			continue
+		}
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			continue
+		}
+		go s.handleSession(channel, requests)
+	}
+}
+
+// forward connects a direct-tcpip channel to the address it asks for, so
+// that the server can act as a bastion
+func (s *testSSHServer) forward(newChannel ssh.NewChannel) {
+	var payload struct {
+		Host       string
+		Port       uint32
+		OriginHost string
+		OriginPort uint32
+	}
+	if err := ssh.Unmarshal(newChannel.ExtraData(), &payload); err != nil {
+		newChannel.Reject(ssh.Prohibited, err.Error())
+		return
+	}
+	conn, err := net.Dial("tcp", net.JoinHostPort(payload.Host, strconv.Itoa(int(payload.Port))))
+	if err != nil {
+		newChannel.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+	channel, requests, err := newChannel.Accept()
+	if err != nil {
+		conn.Close()
+		return
+	}
+	go ssh.DiscardRequests(requests)
+	go func() {
+		_, _ = io.Copy(channel, conn)
+		channel.CloseWrite()
+	}()
+	_, _ = io.Copy(conn, channel)
+	conn.Close()
+	channel.Close()
+}
+
+func (s *testSSHServer) handleSession(channel ssh.Channel, requests <-chan *ssh.Request) {
+	defer channel.Close()
+	for req := range requests {
+		var payload struct{ Value string }
+		switch req.Type {
+		case "exec":
+			if err := ssh.Unmarshal(req.Payload, &payload); err != nil {
+				req.Reply(false, nil)
+				continue
+			}
+			req.Reply(true, nil)
+			status := s.exec(channel, payload.Value)
+			channel.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{status}))
+			return
+		case "subsystem":
+			if err := ssh.Unmarshal(req.Payload, &payload); err != nil || payload.Value != "sftp" {
+				req.Reply(false, nil)
+				continue
+			}
+			req.Reply(true, nil)
+			server, err := sftp.NewServer(channel)
+			if err != nil {
+				return
+			}
+			server.Serve()
+			return
+		default:
+			if req.WantReply {
+				req.Reply(false, nil)
+			}
+		}
+	}
+}
+
+// exec runs a command for a session and returns its exit status
+func (s *testSSHServer) exec(channel ssh.Channel, command string) uint32 {
+	cmd := exec.Command("sh", "-c", command)
+	cmd.Env = append(os.Environ(),
+		fmt.Sprintf("PATH=%s:%s", filepath.Join(s.Root, "bin"), os.Getenv("PATH")),
+		fmt.Sprintf("GLUE_TEST_ROOT=%s", s.Root),
+	)
+	cmd.Stdin = channel
+	cmd.Stdout = channel
+	cmd.Stderr = channel.Stderr()
+	err := cmd.Run()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return uint32(exitErr.ExitCode())
+	} else if err != nil {
+		io.WriteString(channel.Stderr(), err.Error())
+		return 127
+	}
+	return 0
+}
+
+// testConfig returns a glue.yaml fragment connecting a resource to the
+// test server
+func (s *testSSHServer) testConfig() string {
+	return strings.Join([]string{
+		"  host: " + s.Host,
+		"  port: " + strconv.Itoa(s.Port),
+		"  password: " + testServerPassword,
+		"  hostKey:",
+		"    knownHosts: " + s.KnownHosts,
+	}, "\n") + "\n"
+}
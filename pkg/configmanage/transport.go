@@ -0,0 +1,45 @@
+package configmanage
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+)
+
+// Supported values for the transport of a managed resource
+const (
+	transportSSH   string = "ssh"
+	transportLocal string = "local"
+)
+
+// Transport performs work on a managed resource - all commands and file
+// transfers glueprint makes against a host go through one
+type Transport interface {
+	// Run executes a command on the host, feeding it stdin if supplied -
+	// a command exiting with a non-zero status returns both its result
+	// and an error
+	Run(command string, stdin io.Reader) (CommandResult, error)
+	// PutFile writes content to the file at path on the host
+	PutFile(path string, content io.Reader) (int64, error)
+	// GetFile returns the contents of the file at path on the host
+	GetFile(path string) ([]byte, error)
+	// Stat describes the file at path on the host
+	Stat(path string) (fs.FileInfo, error)
+}
+
+// newTransport returns the transport used to reach a managed resource
+func newTransport(credentials Credentials) (Transport, error) {
+	var transport Transport
+	switch credentials.Transport {
+	case "", transportSSH:
+		transport = &sshTransport{credentials: credentials}
+	case transportLocal:
+		transport = &localTransport{credentials: credentials}
+	default:
+		return nil, fmt.Errorf("unknown transport %s", credentials.Transport)
+	}
+	if credentials.Become {
+		transport = &becomeTransport{Transport: transport, password: credentials.BecomePassword}
+	}
+	return transport, nil
+}
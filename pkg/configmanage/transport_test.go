@@ -0,0 +1,429 @@
+package configmanage
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+// fakeTransport is a scripted Transport - commands are answered from
+// results and files are served from an in-memory map
+type fakeTransport struct {
+	results  map[string]CommandResult
+	files    map[string][]byte
+	commands []string
+}
+
+func newFakeTransport(results map[string]CommandResult, files map[string][]byte) *fakeTransport {
+	if results == nil {
+		results = map[string]CommandResult{}
+	}
+	if files == nil {
+		files = map[string][]byte{}
+	}
+	return &fakeTransport{results: results, files: files}
+}
+
+func (t *fakeTransport) Run(command string, stdin io.Reader) (CommandResult, error) {
+	t.commands = append(t.commands, command)
+	result, ok := t.results[command]
+	if !ok {
+		return CommandResult{ExitStatus: -1}, fmt.Errorf("unexpected command: %s", command)
+	}
+	if result.ExitStatus != 0 {
+		return result, fmt.Errorf("command exited with status %d", result.ExitStatus)
+	}
+	return result, nil
+}
+
+func (t *fakeTransport) PutFile(path string, content io.Reader) (int64, error) {
+	var buf bytes.Buffer
+	n, err := io.Copy(&buf, content)
+	if err != nil {
+		return 0, err
+	}
+	t.files[path] = buf.Bytes()
+	return n, nil
+}
+
+func (t *fakeTransport) GetFile(path string) ([]byte, error) {
+	content, ok := t.files[path]
+	if !ok {
+		return nil, &fs.PathError{Op: "open", Path: path, Err: fs.ErrNotExist}
+	}
+	return content, nil
+}
+
+func (t *fakeTransport) Stat(path string) (fs.FileInfo, error) {
+	content, ok := t.files[path]
+	if !ok {
+		return nil, &fs.PathError{Op: "stat", Path: path, Err: fs.ErrNotExist}
+	}
+	return fakeFileInfo{name: filepath.Base(path), size: int64(len(content))}, nil
+}
+
+type fakeFileInfo struct {
+	name string
+	size int64
+}
+
+func (fi fakeFileInfo) Name() string       { return fi.name }
+func (fi fakeFileInfo) Size() int64        { return fi.size }
+func (fi fakeFileInfo) Mode() fs.FileMode  { return 0644 }
+func (fi fakeFileInfo) ModTime() time.Time { return time.Time{} }
+func (fi fakeFileInfo) IsDir() bool        { return false }
+func (fi fakeFileInfo) Sys() interface{}   { return nil }
+
+func TestGetPackageDiffs(t *testing.T) {
+	apache := PackageSpecification{Package: "apache2"}
+	php := PackageSpecification{Package: "php", Version: "2:8.1"}
+
+	tests := []struct {
+		name    string
+		results map[string]CommandResult
+		pkgs    []PackageSpecification
+		want    []PackageResourceDiff
+		wantErr bool
+	}{
+		{
+			name: "A package that is not installed should be installed",
+			results: map[string]CommandResult{
+				"dpkg-query --show apache2": {Stderr: "dpkg-query: no packages found matching apache2\n", ExitStatus: 1},
+			},
+			pkgs: []PackageSpecification{apache},
+			want: []PackageResourceDiff{{Operation: "INSTALL", PackageResource: apache}},
+		},
+		{
+			name: "A package installed at a different version should be installed at the requested version",
+			results: map[string]CommandResult{
+				"dpkg-query --show php":                           {Stdout: "php\t2:8.0"},
+				"dpkg-query --showformat='${Version}' --show php": {Stdout: "2:8.0"},
+			},
+			pkgs: []PackageSpecification{php},
+			want: []PackageResourceDiff{{Operation: "INSTALL", PackageResource: php}},
+		},
+		{
+			name: "A package installed at the requested version should be unchanged",
+			results: map[string]CommandResult{
+				"dpkg-query --show php":                           {Stdout: "php\t2:8.1"},
+				"dpkg-query --showformat='${Version}' --show php": {Stdout: "2:8.1"},
+			},
+			pkgs: []PackageSpecification{php},
+			want: []PackageResourceDiff{},
+		},
+		{
+			name:    "A host that can't be queried should be an error",
+			pkgs:    []PackageSpecification{apache},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			transport := newFakeTransport(tt.results, nil)
+			got, err := GetPackageDiffs(transport, tt.pkgs, ManagedResource{})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("GetPackageDiffs() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("GetPackageDiffs() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGetFileDiffs(t *testing.T) {
+	// Source files are read relative to the working directory
+	chdir(t, t.TempDir())
+	content := []byte("<?php phpinfo(); ?>\n")
+	writeFile(t, "index.php", string(content))
+	writeFile(t, "other.php", "<?php echo 'other'; ?>\n")
+	localHash := fmt.Sprintf("%x", sha1.Sum(content))
+
+	index := FileSpecification{Name: "index.php", Path: "/var/www/html", Mode: "0600"}
+	indexNewMode := FileSpecification{Name: "index.php", Path: "/var/www/html", Mode: "0644"}
+	indexNewOwner := FileSpecification{Name: "index.php", Path: "/var/www/html", Mode: "0600", Owner: "www-data"}
+	info := FileSpecification{Source: "index.php", Dest: "/var/www/html/info.php", Mode: "0600"}
+	indexMoved := FileSpecification{Name: "index.php", Path: "/srv/www", Mode: "0600"}
+	indexFromSource := FileSpecification{Source: "index.php", Dest: "/srv/www/", Mode: "0600"}
+	indexFromOther := FileSpecification{Source: "other.php", Dest: "/var/www/html/index.php", Mode: "0600"}
+	dirConfContent := "DirectoryIndex index.php\n"
+	dirConf := FileSpecification{Name: "dir.conf", Path: "/etc/apache2/mods-enabled", Mode: "0644", Content: &dirConfContent}
+
+	tests := []struct {
+		name      string
+		results   map[string]CommandResult
+		files     map[string][]byte
+		specs     []FileSpecification
+		fromState ManagedResource
+		want      []FileResourceDiff
+	}{
+		{
+			name:      "A file not in state should be created",
+			specs:     []FileSpecification{index},
+			fromState: ManagedResource{},
+			want:      []FileResourceDiff{{Operation: "CREATE", FileResource: index}},
+		},
+		{
+			name:      "A file removed from the configuration should be deleted",
+			specs:     []FileSpecification{},
+			fromState: ManagedResource{Files: []FileSpecification{index}},
+			want:      []FileResourceDiff{{Operation: "DELETE", FileResource: index}},
+		},
+		{
+			name: "A file whose mode has changed should be updated",
+			results: map[string]CommandResult{
+				"sha1sum '/var/www/html/index.php'": {Stdout: localHash + "  /var/www/html/index.php"},
+			},
+			files:     map[string][]byte{"/var/www/html/index.php": content},
+			specs:     []FileSpecification{indexNewMode},
+			fromState: ManagedResource{Files: []FileSpecification{index}},
+			want:      []FileResourceDiff{{Operation: "UPDATE", Target: "Mode", UpdateValue: "0644", FileResource: indexNewMode}},
+		},
+		{
+			name: "A file whose owner has changed should be updated",
+			results: map[string]CommandResult{
+				"sha1sum '/var/www/html/index.php'": {Stdout: localHash + "  /var/www/html/index.php"},
+			},
+			files:     map[string][]byte{"/var/www/html/index.php": content},
+			specs:     []FileSpecification{indexNewOwner},
+			fromState: ManagedResource{Files: []FileSpecification{index}},
+			want:      []FileResourceDiff{{Operation: "UPDATE", Target: "Owner", UpdateValue: "www-data", FileResource: indexNewOwner}},
+		},
+		{
+			name: "Reordered files should be unchanged",
+			results: map[string]CommandResult{
+				"sha1sum '/var/www/html/index.php'": {Stdout: localHash + "  /var/www/html/index.php"},
+				"sha1sum '/var/www/html/info.php'":  {Stdout: localHash + "  /var/www/html/info.php"},
+			},
+			files: map[string][]byte{
+				"/var/www/html/index.php": content,
+				"/var/www/html/info.php":  content,
+			},
+			specs:     []FileSpecification{info, index},
+			fromState: ManagedResource{Files: []FileSpecification{index, info}},
+			want:      nil,
+		},
+		{
+			name:      "A file whose destination has changed should be moved",
+			results:   map[string]CommandResult{},
+			specs:     []FileSpecification{indexMoved},
+			fromState: ManagedResource{Files: []FileSpecification{index}},
+			want: []FileResourceDiff{
+				{Operation: "CREATE", FileResource: indexMoved},
+				{Operation: "DELETE", FileResource: index},
+			},
+		},
+		{
+			name: "Files sharing a name should be tracked by destination",
+			results: map[string]CommandResult{
+				"sha1sum '/var/www/html/index.php'": {Stdout: localHash + "  /var/www/html/index.php"},
+			},
+			files:     map[string][]byte{"/var/www/html/index.php": content},
+			specs:     []FileSpecification{index, indexFromSource},
+			fromState: ManagedResource{Files: []FileSpecification{index}},
+			want:      []FileResourceDiff{{Operation: "CREATE", FileResource: indexFromSource}},
+		},
+		{
+			name: "A file sourced from a different local file should be replaced",
+			results: map[string]CommandResult{
+				"sha1sum '/var/www/html/index.php'": {Stdout: localHash + "  /var/www/html/index.php"},
+			},
+			files:     map[string][]byte{"/var/www/html/index.php": content},
+			specs:     []FileSpecification{indexFromOther},
+			fromState: ManagedResource{Files: []FileSpecification{index}},
+			want:      []FileResourceDiff{{Operation: "REPLACE", FileResource: indexFromOther}},
+		},
+		{
+			name: "A file whose content matches should be unchanged",
+			results: map[string]CommandResult{
+				"sha1sum '/var/www/html/index.php'": {Stdout: localHash + "  /var/www/html/index.php"},
+			},
+			files:     map[string][]byte{"/var/www/html/index.php": content},
+			specs:     []FileSpecification{index},
+			fromState: ManagedResource{Files: []FileSpecification{index}},
+			want:      nil,
+		},
+		{
+			name: "A file whose content has changed should be replaced",
+			results: map[string]CommandResult{
+				"sha1sum '/var/www/html/index.php'": {Stdout: "da39a3ee5e6b4b0d3255bfef95601890afd80709  /var/www/html/index.php"},
+			},
+			files:     map[string][]byte{"/var/www/html/index.php": []byte("")},
+			specs:     []FileSpecification{index},
+			fromState: ManagedResource{Files: []FileSpecification{index}},
+			want:      []FileResourceDiff{{Operation: "REPLACE", FileResource: index}},
+		},
+		{
+			name: "A file with matching inline content should be unchanged",
+			results: map[string]CommandResult{
+				"sha1sum '/etc/apache2/mods-enabled/dir.conf'": {Stdout: fmt.Sprintf("%x", sha1.Sum([]byte(dirConfContent))) + "  /etc/apache2/mods-enabled/dir.conf"},
+			},
+			files:     map[string][]byte{"/etc/apache2/mods-enabled/dir.conf": []byte(dirConfContent)},
+			specs:     []FileSpecification{dirConf},
+			fromState: ManagedResource{Files: []FileSpecification{dirConf}},
+			want:      nil,
+		},
+		{
+			name: "A file whose inline content has changed should be replaced",
+			results: map[string]CommandResult{
+				"sha1sum '/etc/apache2/mods-enabled/dir.conf'": {Stdout: "da39a3ee5e6b4b0d3255bfef95601890afd80709  /etc/apache2/mods-enabled/dir.conf"},
+			},
+			files:     map[string][]byte{"/etc/apache2/mods-enabled/dir.conf": []byte("")},
+			specs:     []FileSpecification{dirConf},
+			fromState: ManagedResource{Files: []FileSpecification{dirConf}},
+			want:      []FileResourceDiff{{Operation: "REPLACE", FileResource: dirConf}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			transport := newFakeTransport(tt.results, tt.files)
+			if got := GetFileDiffs(transport, tt.specs, tt.fromState); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("GetFileDiffs() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUploadFile(t *testing.T) {
+	chdir(t, t.TempDir())
+	writeFile(t, "index.php", "<?php phpinfo(); ?>\n")
+	empty := ""
+	inline := "DirectoryIndex index.php\n"
+
+	tests := []struct {
+		name     string
+		file     FileSpecification
+		dest     string
+		want     string
+		commands []string
+	}{
+		{
+			name: "A local file should be uploaded",
+			file: FileSpecification{Name: "index.php", Path: "/var/www/html"},
+			dest: "/var/www/html/index.php",
+			want: "<?php phpinfo(); ?>\n",
+		},
+		{
+			name: "Inline content should be uploaded",
+			file: FileSpecification{Name: "dir.conf", Path: "/etc/apache2/mods-enabled", Content: &inline},
+			dest: "/etc/apache2/mods-enabled/dir.conf",
+			want: inline,
+		},
+		{
+			name: "Empty inline content should upload an empty file",
+			file: FileSpecification{Dest: "/var/lib/app/.initialised", Content: &empty},
+			dest: "/var/lib/app/.initialised",
+			want: "",
+		},
+		{
+			name:     "The mode should be applied after upload",
+			file:     FileSpecification{Name: "index.php", Path: "/var/www/html", Mode: "0600"},
+			dest:     "/var/www/html/index.php",
+			want:     "<?php phpinfo(); ?>\n",
+			commands: []string{"chmod '0600' '/var/www/html/index.php'"},
+		},
+		{
+			name:     "The owner should only be changed when set, with the path quoted",
+			file:     FileSpecification{Source: "index.php", Dest: "/var/www/my site/index.php", Mode: "0640", Owner: "www-data:www-data"},
+			dest:     "/var/www/my site/index.php",
+			want:     "<?php phpinfo(); ?>\n",
+			commands: []string{"chmod '0640' '/var/www/my site/index.php'", "chown 'www-data:www-data' '/var/www/my site/index.php'"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			results := map[string]CommandResult{}
+			for _, command := range tt.commands {
+				results[command] = CommandResult{}
+			}
+			transport := newFakeTransport(results, nil)
+			if err := UploadFile(transport, tt.file); err != nil {
+				t.Fatalf("UploadFile() error = %s", err)
+			}
+			got, ok := transport.files[tt.dest]
+			if !ok {
+				t.Fatalf("UploadFile() did not upload to %s, uploaded %v", tt.dest, transport.files)
+			}
+			if string(got) != tt.want {
+				t.Errorf("UploadFile() uploaded %q, want %q", got, tt.want)
+			}
+			if !reflect.DeepEqual(transport.commands, tt.commands) {
+				t.Errorf("UploadFile() ran %q, want %q", transport.commands, tt.commands)
+			}
+		})
+	}
+}
+
+func TestBecomePutFile(t *testing.T) {
+	tests := []struct {
+		name    string
+		path    string
+		command string
+		putErr  bool
+		wantErr bool
+	}{
+		{
+			name:    "The file should be written into place keeping its owner, or created owned by root",
+			path:    "/etc/nginx/nginx.conf",
+			command: `sudo -n sh -c 'if [ -e '"'"'/etc/nginx/nginx.conf'"'"' ]; then cat '"'"'/tmp/glueprint.abc123'"'"' > '"'"'/etc/nginx/nginx.conf'"'"'; else install -o root -g root -m 0644 '"'"'/tmp/glueprint.abc123'"'"' '"'"'/etc/nginx/nginx.conf'"'"'; fi'`,
+		},
+		{
+			name:    "Paths with shell metacharacters should be quoted",
+			path:    "/srv/my site/$(id).conf",
+			command: `sudo -n sh -c 'if [ -e '"'"'/srv/my site/$(id).conf'"'"' ]; then cat '"'"'/tmp/glueprint.abc123'"'"' > '"'"'/srv/my site/$(id).conf'"'"'; else install -o root -g root -m 0644 '"'"'/tmp/glueprint.abc123'"'"' '"'"'/srv/my site/$(id).conf'"'"'; fi'`,
+		},
+		{
+			name:    "The staged file should be removed when it can't be written into place",
+			path:    "/etc/nginx/nginx.conf",
+			wantErr: true,
+		},
+		{
+			name:    "The staged file should be removed when the upload fails",
+			path:    "/etc/nginx/nginx.conf",
+			putErr:  true,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			results := map[string]CommandResult{
+				"mktemp /tmp/glueprint.XXXXXX":  {Stdout: "/tmp/glueprint.abc123\n"},
+				"rm -f '/tmp/glueprint.abc123'": {},
+			}
+			if tt.command != "" {
+				results[tt.command] = CommandResult{}
+			}
+			inner := newFakeTransport(results, nil)
+			transport := &becomeTransport{Transport: inner}
+			var content io.Reader = bytes.NewReader([]byte("content"))
+			if tt.putErr {
+				content = iotest.ErrReader(errors.New("connection lost"))
+			}
+			_, err := transport.PutFile(tt.path, content)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("PutFile() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if _, ok := inner.files["/tmp/glueprint.abc123"]; !ok && !tt.putErr {
+				t.Errorf("PutFile() did not stage the file, uploaded %v", inner.files)
+			}
+			last := inner.commands[len(inner.commands)-1]
+			if last != "rm -f '/tmp/glueprint.abc123'" {
+				t.Errorf("PutFile() ran %q, want the staged file removed last", inner.commands)
+			}
+			if tt.command != "" {
+				want := []string{"mktemp /tmp/glueprint.XXXXXX", tt.command, "rm -f '/tmp/glueprint.abc123'"}
+				if !reflect.DeepEqual(inner.commands, want) {
+					t.Errorf("PutFile() ran %q, want %q", inner.commands, want)
+				}
+			}
+		})
+	}
+}
@@ -1,17 +1,97 @@
 package configmanage
 
+import "time"
+
 type ManagedResource struct {
-	Host     string                 `yaml:"host" json:"host"`
-	Password string                 `yaml:"password" json:"password"`
-	Files    []FileSpecification    `yaml:"files" json:"files"`
-	Packages []PackageSpecification `yaml:"packages" json:"packages"`
-	Command  []string               `yaml:"command" json:"command"`
+	Host           string                 `yaml:"host" json:"host"`
+	Port           int                    `yaml:"port" json:"port"`
+	User           string                 `yaml:"user" json:"user"`
+	Password       Secret                 `yaml:"password" json:"password"`
+	Become         bool                   `yaml:"become" json:"become"`
+	BecomePassword Secret                 `yaml:"becomePassword" json:"becomePassword"`
+	Transport      string                 `yaml:"transport" json:"transport"`
+	Files          []FileSpecification    `yaml:"files" json:"files"`
+	Packages       []PackageSpecification `yaml:"packages" json:"packages"`
+	Command        []string               `yaml:"command" json:"command"`
+	Auth           AuthSpecification      `yaml:"auth" json:"auth"`
+	HostKey        HostKeySpecification   `yaml:"hostKey" json:"hostKey"`
+	Bastion        *BastionSpecification  `yaml:"bastion" json:"bastion"`
+	Timeouts       TimeoutSpecification   `yaml:"timeouts" json:"timeouts"`
+	Retries        *int                   `yaml:"retries" json:"retries"`
+	Vars           map[string]interface{} `yaml:"vars" json:"vars,omitempty"`
+	Use            []ModuleCall           `yaml:"use" json:"use,omitempty"`
+	// secrets are those in the secrets file alongside the configuration
+	// file declaring the resource
+	secrets secretStore
+	// dir is the directory of the configuration file declaring the
+	// resource, which local key and known hosts paths are relative to
+	dir string
+}
+
+type AuthSpecification struct {
+	// Method is one of password (default), key, certificate or agent
+	Method string `yaml:"method" json:"method"`
+	Key    string `yaml:"key" json:"key"`
+	// Certificate defaults to the key path with -cert.pub appended
+	Certificate string `yaml:"certificate" json:"certificate"`
+	Passphrase  Secret `yaml:"passphrase" json:"passphrase"`
+}
+
+// BastionSpecification describes a jump host used to reach a managed
+// resource - bastions may themselves be reached through another bastion
+type BastionSpecification struct {
+	Host     string                `yaml:"host" json:"host"`
+	Port     int                   `yaml:"port" json:"port"`
+	User     string                `yaml:"user" json:"user"`
+	Password Secret                `yaml:"password" json:"password"`
+	Auth     AuthSpecification     `yaml:"auth" json:"auth"`
+	Bastion  *BastionSpecification `yaml:"bastion" json:"bastion"`
+}
+
+// TimeoutSpecification accepts durations such as 30s or 5m
+type TimeoutSpecification struct {
+	Connect   time.Duration `yaml:"connect" json:"connect"`
+	Command   time.Duration `yaml:"command" json:"command"`
+	Keepalive time.Duration `yaml:"keepalive" json:"keepalive"`
+}
+
+type HostKeySpecification struct {
+	// KnownHosts defaults to ~/.ssh/known_hosts
+	KnownHosts      string `yaml:"knownHosts" json:"knownHosts"`
+	TrustOnFirstUse bool   `yaml:"trustOnFirstUse" json:"trustOnFirstUse"`
+	// CertAuthority is a file of host CA public keys whose signed host
+	// certificates are trusted
+	CertAuthority string `yaml:"certAuthority" json:"certAuthority"`
 }
 
 type FileSpecification struct {
+	// Name and Path are used when Source and Dest are not set, with
+	// Name as both the local file and the filename on the host
 	Name string `yaml:"name" json:"name"`
 	Path string `yaml:"path" json:"path"`
+	// Source is the local file to read content from
+	Source string `yaml:"source" json:"source,omitempty"`
+	// Dest is the full path of the file on the host
+	Dest string `yaml:"dest" json:"dest,omitempty"`
 	Mode string `yaml:"mode" json:"mode"`
+	// Owner is passed to chown as user or user:group, and ownership is
+	// left alone when it is not set
+	Owner string `yaml:"owner" json:"owner,omitempty"`
+	// Secret sources the file's content from an entry in the encrypted
+	// secrets file rather than a local file
+	Secret string `yaml:"secret" json:"secret"`
+	// Content is the file's content written inline in place of a local
+	// file, and may be empty
+	Content *string `yaml:"content" json:"content,omitempty"`
+	// Template renders the content with text/template before upload
+	Template bool `yaml:"template" json:"template,omitempty"`
+	// Dir is the directory of the configuration file declaring the
+	// file, which Name is read relative to
+	Dir string `yaml:"-" json:"-"`
+	// rendered holds the content of a templated file once rendered
+	rendered []byte
+	// secrets are those the Secret field is looked up in
+	secrets secretStore
 }
 
 type PackageSpecification struct {
@@ -19,6 +99,54 @@ type PackageSpecification struct {
 	Version string `yaml:"version" json:"version"`
 }
 
+// RoleSpecification is a reusable set of files, packages and a command
+// that can be applied to many hosts
+type RoleSpecification struct {
+	Files    []FileSpecification    `yaml:"files" json:"files"`
+	Packages []PackageSpecification `yaml:"packages" json:"packages"`
+	Command  []string               `yaml:"command" json:"command"`
+	Vars     map[string]interface{} `yaml:"vars" json:"vars"`
+}
+
+// GroupSpecification applies roles to a list of hosts that share
+// connection settings
+type GroupSpecification struct {
+	ManagedResource `yaml:",inline"`
+	Hosts           []string `yaml:"hosts"`
+	Roles           []string `yaml:"roles"`
+}
+
+// HostSpecification applies roles to a single host
+type HostSpecification struct {
+	ManagedResource `yaml:",inline"`
+	Roles           []string `yaml:"roles"`
+}
+
+// ModuleCall uses a module from a resource, passing it inputs
+type ModuleCall struct {
+	Module string            `yaml:"module" json:"module"`
+	Inputs map[string]string `yaml:"inputs" json:"inputs,omitempty"`
+	// Line is where the module is used in the configuration file
+	Line int `yaml:"-" json:"-"`
+}
+
+// ModuleSpecification is the contents of a module's module.yaml
+type ModuleSpecification struct {
+	Inputs   map[string]InputSpecification `yaml:"inputs"`
+	Files    []FileSpecification           `yaml:"files"`
+	Packages []PackageSpecification        `yaml:"packages"`
+	Command  []string                      `yaml:"command"`
+	Vars     map[string]interface{}        `yaml:"vars"`
+	Use      []ModuleCall                  `yaml:"use"`
+}
+
+// InputSpecification declares an input to a module - inputs without a
+// default must be given by every resource using the module
+type InputSpecification struct {
+	Description string  `yaml:"description"`
+	Default     *string `yaml:"default"`
+}
+
 // These structs describe actions that can be taken on resources
 
 type FileResourceDiff struct {
@@ -2,6 +2,13 @@ package configmanage
 
 import (
 	"fmt"
+	"net"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
 
 	"github.com/kyokomi/emoji/v2"
 	log "github.com/sirupsen/logrus"
@@ -9,42 +16,54 @@ import (
 
 // Validate parses fields in a configuration file and returns
 // whether or not the file structure is valid
-func Validate() {
+func Validate(opts Options) error {
 	// Parse contents of the configuration file
-	parsedFileContents, err := parseConfigurationFile()
+	parsedFileContents, err := parseConfigurationFile(opts)
 	if err != nil {
-		log.Error(err)
+		logErrors(err)
+		return err
 	}
 
 	// Validate discovered components
+	var errs errorList
 	for _, obj := range parsedFileContents {
-		validateManagedResources(obj, false)
+		errs = append(errs, validateManagedResources(obj, false)...)
 	}
+	if len(errs) > 0 {
+		logErrors(errs)
+		return errs
+	}
+	return nil
 }
 
 // validateManagedResources parses resources specified in the
-// configuration file and validates them
-func validateManagedResources(resource map[string]ManagedResource, silent bool) bool {
-	var validates bool
-	for k, v := range resource {
+// configuration file and validates them, returning every problem found
+func validateManagedResources(resource map[string]ManagedResource, silent bool) errorList {
+	var errs errorList
+	names := make([]string, 0, len(resource))
+	for k := range resource {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	for _, k := range names {
+		v := resource[k]
 		if !silent {
 			_, err := emoji.Printf(":package: %s\n", k)
 			if err != nil {
 				log.Fatal(err)
 			}
 		}
-		if len(v.Files) >= 1 && len(v.Packages) >= 1 {
+		if resourceErrs := validateResource(k, v); len(resourceErrs) == 0 {
 			_, err := emoji.Printf(":white_check_mark: %s %s\n", k, "Passes Validation")
 			if err != nil {
 				log.Fatal(err)
 			}
-			validates = true
 		} else {
 			_, err := emoji.Printf(":x: %s %s\n", k, "Fails Validation")
 			if err != nil {
 				log.Fatal(err)
 			}
-			validates = false
+			errs = append(errs, resourceErrs...)
 		}
 
 		if !silent {
@@ -55,8 +74,14 @@ func validateManagedResources(resource map[string]ManagedResource, silent bool)
 			}
 			if len(v.Files) >= 1 {
 				for _, v := range v.Files {
-					fmt.Printf("	Filename: %s\n", v.Name)
-					fmt.Printf("	Path: %s\n", v.Path)
+					if v.Secret != "" {
+						fmt.Printf("	Secret: %s\n", v.Secret)
+					} else if v.Content != nil {
+						fmt.Printf("	Content: %d bytes inline\n", len(*v.Content))
+					} else {
+						fmt.Printf("	Source: %s\n", v.source())
+					}
+					fmt.Printf("	Destination: %s\n", v.destination())
 					fmt.Printf("	Mode: %v\n", v.Mode)
 				}
 			} else {
@@ -81,5 +106,193 @@ func validateManagedResources(resource map[string]ManagedResource, silent bool)
 			fmt.Printf("----------\n\n")
 		}
 	}
-	return validates
+	return errs
+}
+
+// Matches a hostname made of labels of letters, digits and hyphens as
+// described in RFC 1123
+var hostnamePattern = regexp.MustCompile(`^[A-Za-z0-9]([A-Za-z0-9-]{0,61}[A-Za-z0-9])?(\.[A-Za-z0-9]([A-Za-z0-9-]{0,61}[A-Za-z0-9])?)*\.?$`)
+
+// Matches a Debian package name, optionally qualified with its
+// architecture
+var packageNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9+.-]+(:[a-z0-9-]+)?$`)
+
+// Match the parts of a Debian package version -
+// [epoch:]upstream_version[-debian_revision]
+var (
+	epochPattern           = regexp.MustCompile(`^[0-9]+$`)
+	upstreamVersionPattern = regexp.MustCompile(`^[0-9][A-Za-z0-9.+~-]*$`)
+	debianRevisionPattern  = regexp.MustCompile(`^[A-Za-z0-9.+~]+$`)
+)
+
+// Every section of a resource is optional, so each kind of item in it
+// has its own set of rules that it is checked against
+
+// resourceRules are checked against every resource
+var resourceRules = []func(resource ManagedResource) error{
+	func(resource ManagedResource) error {
+		// Local resources are managed without connecting to a host
+		if resource.Host == "" && resource.Transport == transportLocal {
+			return nil
+		}
+		return validateHost(resource.Host)
+	},
+	func(resource ManagedResource) error {
+		if resource.Bastion == nil {
+			return nil
+		}
+		if err := validateHost(resource.Bastion.Host); err != nil {
+			return fmt.Errorf("bastion %s", err)
+		}
+		return nil
+	},
+}
+
+// fileRules are checked against every file with a destination
+var fileRules = []func(file FileSpecification) error{
+	func(file FileSpecification) error {
+		if file.Path != "" && !path.IsAbs(file.Path) {
+			return fmt.Errorf("path %s must be absolute", file.Path)
+		} else if !path.IsAbs(file.destination()) {
+			return fmt.Errorf("dest must be absolute")
+		}
+		return nil
+	},
+	func(file FileSpecification) error {
+		return validateMode(file.Mode)
+	},
+	func(file FileSpecification) error {
+		if file.Secret != "" || file.Content != nil {
+			return nil
+		}
+		if _, err := os.Stat(file.source()); err != nil {
+			return fmt.Errorf("source %s does not exist", file.source())
+		}
+		return nil
+	},
+}
+
+// packageRules are checked against every package
+var packageRules = []func(pkg PackageSpecification) error{
+	func(pkg PackageSpecification) error {
+		if !packageNamePattern.MatchString(pkg.Package) {
+			return fmt.Errorf("%q is not a valid package name", pkg.Package)
+		}
+		return nil
+	},
+	func(pkg PackageSpecification) error {
+		return validateVersion(pkg.Version)
+	},
+}
+
+// validateResource returns every problem with a resource and the items
+// declared in it
+func validateResource(name string, resource ManagedResource) errorList {
+	var errs errorList
+	for _, err := range resource.validate() {
+		errs = append(errs, fmt.Errorf("resource %s: %s", name, err))
+	}
+	return errs
+}
+
+// validate checks a resource against its rules, then each of its files
+// and packages against theirs
+func (r ManagedResource) validate() errorList {
+	var errs errorList
+	for _, rule := range resourceRules {
+		if err := rule(r); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	destinations := map[string]bool{}
+	for i, file := range r.Files {
+		dest := file.destination()
+		if (file.Dest != "" || file.Name != "") && destinations[dest] {
+			errs = append(errs, fmt.Errorf("file %s is declared more than once", dest))
+			continue
+		}
+		destinations[dest] = true
+		errs = append(errs, file.validate(i)...)
+	}
+	for _, pkg := range r.Packages {
+		errs = append(errs, pkg.validate()...)
+	}
+	return errs
+}
+
+// validate checks a file against the file rules, where index is its
+// position in the resource's files
+func (f FileSpecification) validate(index int) errorList {
+	if f.Dest == "" && f.Name == "" {
+		return errorList{fmt.Errorf("files[%d] has no destination, set dest or name and path", index)}
+	}
+	dest := f.destination()
+	var errs errorList
+	for _, rule := range fileRules {
+		if err := rule(f); err != nil {
+			errs = append(errs, fmt.Errorf("file %s: %s", dest, err))
+		}
+	}
+	return errs
+}
+
+// validate checks a package against the package rules
+func (p PackageSpecification) validate() errorList {
+	var errs errorList
+	for _, rule := range packageRules {
+		if err := rule(p); err != nil {
+			errs = append(errs, fmt.Errorf("package %s: %s", p.Package, err))
+		}
+	}
+	return errs
+}
+
+// validateHost checks that a host is an IP address or hostname
+func validateHost(host string) error {
+	if host == "" {
+		return fmt.Errorf("host is not set")
+	}
+	if net.ParseIP(host) == nil && (len(host) > 253 || !hostnamePattern.MatchString(host)) {
+		return fmt.Errorf("host %q is not a valid IP address or hostname", host)
+	}
+	return nil
+}
+
+// validateMode checks that a file mode, if set, is an octal permission
+// such as 0644
+func validateMode(mode string) error {
+	if mode == "" {
+		return nil
+	}
+	value, err := strconv.ParseUint(mode, 8, 32)
+	if err != nil || value > 07777 {
+		return fmt.Errorf("mode %s is not a valid octal file mode", mode)
+	}
+	return nil
+}
+
+// validateVersion checks that a package version, if set, follows the
+// Debian version format - latest installs the newest version available
+func validateVersion(version string) error {
+	if version == "" || version == "latest" {
+		return nil
+	}
+	upstream := version
+	if i := strings.Index(upstream, ":"); i >= 0 {
+		if !epochPattern.MatchString(upstream[:i]) {
+			return fmt.Errorf("version %s has an invalid epoch", version)
+		}
+		upstream = upstream[i+1:]
+	}
+	if i := strings.LastIndex(upstream, "-"); i >= 0 {
+		if !debianRevisionPattern.MatchString(upstream[i+1:]) {
+			return fmt.Errorf("version %s has an invalid Debian revision", version)
+		}
+		upstream = upstream[:i]
+	}
+	if !upstreamVersionPattern.MatchString(upstream) {
+		return fmt.Errorf("version %s is not a valid Debian package version", version)
+	}
+	return nil
 }
@@ -0,0 +1,165 @@
+package configmanage
+
+import (
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestValidateResource(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "index.php"), "<?php phpinfo(); ?>\n")
+	content := "listen 80;\n"
+	valid := func() ManagedResource {
+		return ManagedResource{
+			Host: "web-1.example.com",
+			Files: []FileSpecification{
+				{Name: "index.php", Path: "/var/www/html", Mode: "0644", Dir: dir},
+				{Content: &content, Dest: "/etc/nginx/conf.d/listen.conf"},
+			},
+			Packages: []PackageSpecification{{Package: "php8.1-fpm", Version: "1:8.1.2-1ubuntu2.14"}},
+		}
+	}
+
+	tests := []struct {
+		name     string
+		modify   func(r *ManagedResource)
+		wantErrs []string
+	}{
+		{
+			name:   "A valid resource should have no problems",
+			modify: func(r *ManagedResource) {},
+		},
+		{
+			name: "Every problem should be reported",
+			modify: func(r *ManagedResource) {
+				r.Host = "web_1.example.com"
+				r.Files[0].Mode = "0999"
+				r.Files[0].Name = "missing.php"
+				r.Files[1].Dest = "conf.d/listen.conf"
+				r.Packages = append(r.Packages, PackageSpecification{Package: "Nginx", Version: "1.0 beta"})
+			},
+			wantErrs: []string{
+				`resource web: host "web_1.example.com" is not a valid IP address or hostname`,
+				"resource web: file /var/www/html/missing.php: mode 0999 is not a valid octal file mode",
+				"resource web: file /var/www/html/missing.php: source " + filepath.Join(dir, "missing.php") + " does not exist",
+				"resource web: file conf.d/listen.conf: dest must be absolute",
+				`resource web: package Nginx: "Nginx" is not a valid package name`,
+				"resource web: package Nginx: version 1.0 beta is not a valid Debian package version",
+			},
+		},
+		{
+			name: "A relative path should be reported",
+			modify: func(r *ManagedResource) {
+				r.Files[0].Path = "var/www/html"
+			},
+			wantErrs: []string{"resource web: file var/www/html/index.php: path var/www/html must be absolute"},
+		},
+		{
+			name: "Two files with the same destination should be reported",
+			modify: func(r *ManagedResource) {
+				r.Files[1].Dest = "/var/www/html/index.php"
+			},
+			wantErrs: []string{"resource web: file /var/www/html/index.php is declared more than once"},
+		},
+		{
+			name: "A resource with only packages should be valid",
+			modify: func(r *ManagedResource) {
+				r.Files = nil
+			},
+		},
+		{
+			name: "A resource with only a command should be valid",
+			modify: func(r *ManagedResource) {
+				r.Files = nil
+				r.Packages = nil
+				r.Command = []string{"systemctl", "restart", "nginx"}
+			},
+		},
+		{
+			name: "A file without a destination should be reported",
+			modify: func(r *ManagedResource) {
+				r.Files[1].Dest = ""
+				r.Files = append(r.Files, FileSpecification{Content: &content})
+			},
+			wantErrs: []string{
+				"resource web: files[1] has no destination, set dest or name and path",
+				"resource web: files[2] has no destination, set dest or name and path",
+			},
+		},
+		{
+			name: "An IP address should be a valid host",
+			modify: func(r *ManagedResource) {
+				r.Host = "2001:db8::1"
+			},
+		},
+		{
+			name: "A resource without a host should only be valid locally",
+			modify: func(r *ManagedResource) {
+				r.Host = ""
+				r.Transport = transportLocal
+				r.Bastion = &BastionSpecification{Host: "-bastion"}
+			},
+			wantErrs: []string{`resource web: bastion host "-bastion" is not a valid IP address or hostname`},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resource := valid()
+			tt.modify(&resource)
+			var got []string
+			for _, err := range validateResource("web", resource) {
+				got = append(got, err.Error())
+			}
+			if !reflect.DeepEqual(got, tt.wantErrs) {
+				t.Errorf("validateResource() =\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(tt.wantErrs, "\n"))
+			}
+		})
+	}
+}
+
+func TestValidateVersion(t *testing.T) {
+	tests := []struct {
+		version string
+		valid   bool
+	}{
+		{version: "", valid: true},
+		{version: "1.18.0", valid: true},
+		{version: "2:8.1", valid: true},
+		{version: "1.18.0-6ubuntu14.4", valid: true},
+		{version: "1:2.4.52-1ubuntu4~22.04.1", valid: true},
+		{version: "7.81.0-1ubuntu1.15+esm1", valid: true},
+		{version: "latest", valid: true},
+		{version: "a:1.0", valid: false},
+		{version: "1.0-", valid: false},
+		{version: "1.0 beta", valid: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.version, func(t *testing.T) {
+			if err := validateVersion(tt.version); (err == nil) != tt.valid {
+				t.Errorf("validateVersion(%q) error = %v, want valid %v", tt.version, err, tt.valid)
+			}
+		})
+	}
+}
+
+func TestValidate(t *testing.T) {
+	chdir(t, t.TempDir())
+	writeTree(t, map[string]string{
+		"glue.yaml":    "web:\n  host: 1.2.3.4\n  files:\n    - name: index.php\n      path: /var/www/html\n  packages:\n    - package: php\n",
+		"index.php":    "<?php phpinfo(); ?>\n",
+		"db/glue.yaml": "db:\n  host: db..example.com\n  files:\n    - name: my.cnf\n      path: /etc/mysql\n  packages:\n    - package: mysql-server\n",
+	})
+	err := Validate(Options{})
+	if err == nil {
+		t.Fatal("Validate() error = nil, want problems with db")
+	}
+	want := []string{
+		`resource db: host "db..example.com" is not a valid IP address or hostname`,
+		"resource db: file /etc/mysql/my.cnf: source " + filepath.Join("db", "my.cnf") + " does not exist",
+	}
+	if got := strings.Split(err.Error(), "\n"); !reflect.DeepEqual(got, want) {
+		t.Errorf("Validate() error =\n%s\nwant\n%s", err, strings.Join(want, "\n"))
+	}
+}